@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//apiPrefix is the path of the versioned json api
+const apiPrefix = "/api/v1/"
+
+//apiError is an api error response with its http status
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+//badRequest returns a 400 api error
+func badRequest(msg string) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Message: msg}
+}
+
+//errorStatus returns the http status of err
+func errorStatus(err error) int {
+	var ae *apiError
+	switch {
+	case errors.As(err, &ae):
+		return ae.Status
+	case errors.Is(err, errInvalidPostName):
+		return http.StatusBadRequest
+	case errors.Is(err, errNoChange), errors.Is(err, errNotScheduled), os.IsNotExist(err):
+		return http.StatusNotFound
+	case errors.Is(err, errConflict), errors.Is(err, errPendingChange), errors.Is(err, errPublishing):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+//writeJSON writes v as the json response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("error writing api response: ", err)
+	}
+}
+
+//writeAPIError writes err as a json error response
+//of the form {"error": {"status": 404, "message": "..."}}
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Println("api error: ", err)
+	}
+	writeJSON(w, status, map[string]*apiError{
+		"error": {Status: status, Message: err.Error()},
+	})
+}
+
+//apiPost is a post in api responses
+type apiPost struct {
+	Name        string     `json:"name"`
+	URL         string     `json:"url"`
+	Title       string     `json:"title"`
+	Author      string     `json:"author,omitempty"`
+	Summary     string     `json:"summary,omitempty"`
+	Tags        []string   `json:"tags"`
+	Draft       bool       `json:"draft"`
+	Date        time.Time  `json:"date"`
+	PublishDate *time.Time `json:"publishdate,omitempty"`
+	Img         string     `json:"img,omitempty"`
+	//Content is the markdown content. Only set for single posts
+	Content string `json:"content,omitempty"`
+	//Change is the id of the post's pending change
+	Change string `json:"change,omitempty"`
+}
+
+func (s *server) apiPost(p *post, content bool) *apiPost {
+	name := postName(p.Fname())
+	fm := p.frontMatter
+	ap := &apiPost{
+		Name:    name,
+		URL:     s.hugo.PostURL(name),
+		Title:   fm.Title,
+		Author:  fm.Author,
+		Summary: fm.Summary,
+		Tags:    fm.Tags,
+		Draft:   fm.Draft,
+		Date:    fm.Date,
+		Img:     fm.Img,
+	}
+	if ap.Tags == nil {
+		ap.Tags = []string{}
+	}
+	if !fm.PublishDate.IsZero() {
+		ap.PublishDate = &fm.PublishDate
+	}
+	if content {
+		ap.Content = string(p.content)
+	}
+	if ch := s.hugo.ChangeFor(name); ch != nil {
+		ap.Change = ch.id
+	}
+	return ap
+}
+
+//apiChange is a pending change in api responses
+type apiChange struct {
+	ID        string     `json:"id"`
+	Post      string     `json:"post"`
+	URL       string     `json:"url"`
+	Message   string     `json:"message"`
+	Created   time.Time  `json:"created"`
+	PublishAt *time.Time `json:"publishat,omitempty"`
+	//Files are the repo paths the change writes
+	Files []string `json:"files"`
+	//Deletes are the repo paths the change removes
+	Deletes []string `json:"deletes,omitempty"`
+	//BuildError is set if the preview failed to
+	//build after the change was staged
+	BuildError string `json:"builderror,omitempty"`
+}
+
+func (s *server) apiChange(c *change) *apiChange {
+	ac := &apiChange{
+		ID:      c.id,
+		Post:    c.name,
+		URL:     s.hugo.PostURL(c.name),
+		Message: c.msg,
+		Created: c.created,
+		Files:   []string{},
+	}
+	if !c.publishAt.IsZero() {
+		ac.PublishAt = &c.publishAt
+	}
+	for fname, b := range c.files {
+		if b == nil {
+			ac.Deletes = append(ac.Deletes, fname)
+		} else {
+			ac.Files = append(ac.Files, fname)
+		}
+	}
+	sort.Strings(ac.Files)
+	sort.Strings(ac.Deletes)
+	return ac
+}
+
+//apiPostRequest is the body of post create and update requests
+type apiPostRequest struct {
+	Title   string   `json:"title"`
+	Summary string   `json:"summary"`
+	Tags    []string `json:"tags"`
+	Draft   bool     `json:"draft"`
+	//PublishDate in RFC 3339 format. Empty publishes now
+	PublishDate string `json:"publishdate"`
+	//Document is the base64 encoded document of type MIME.
+	//MIME defaults to docx
+	Document []byte `json:"document"`
+	MIME     string `json:"mime"`
+	//DriveFile is the id of a google drive document
+	//used in place of Document
+	DriveFile string `json:"drivefile"`
+	//Message is the commit message of the change
+	Message string `json:"message"`
+}
+
+//apiPublishResponse is the result of publishing a change
+type apiPublishResponse struct {
+	Post string `json:"post"`
+	//Scheduled is set if the change was queued for
+	//its publish date instead of published
+	Scheduled *time.Time `json:"scheduled,omitempty"`
+	//PullRequest is the url of the pull request in review mode
+	PullRequest string `json:"pullrequest,omitempty"`
+	//Results of pushing the built site if it failed
+	//and of the post push actions
+	Results []*actionResult `json:"results"`
+	//PostPush is set if post push actions are still
+	//running in the background. Their results are
+	//shown on the status page
+	PostPush bool `json:"postpush,omitempty"`
+}
+
+//apiScheduled is a scheduled post in api responses
+type apiScheduled struct {
+	ID      string    `json:"id"`
+	Post    string    `json:"post"`
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+	//Failed is the error which stopped the post publishing
+	Failed string `json:"failed,omitempty"`
+}
+
+func newAPIScheduled(p *scheduledPost) *apiScheduled {
+	return &apiScheduled{ID: p.ID, Post: p.Name, Message: p.Msg, At: p.At, Failed: p.Failed}
+}
+
+//apiDriveFile is a google drive document in api responses
+type apiDriveFile struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	MIMEType string `json:"mimetype"`
+	Modified string `json:"modified,omitempty"`
+}
+
+//decodeAPIRequest decodes the json body of req into v
+func decodeAPIRequest(req *http.Request, v interface{}) error {
+	dec := json.NewDecoder(io.LimitReader(req.Body, 32<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return badRequest("invalid request body: " + err.Error())
+	}
+	return nil
+}
+
+//apiDetails returns the post details and document of r
+func (s *server) apiDetails(req *http.Request, r *apiPostRequest) (*postDetails, io.ReadCloser, string, error) {
+	d := &postDetails{
+		Title:     strings.TrimSpace(r.Title),
+		Tags:      strings.ToLower(strings.Join(r.Tags, " ")),
+		Summary:   strings.TrimSpace(r.Summary),
+		Author:    s.author(req),
+		Draft:     r.Draft,
+		GitAuthor: gitAuthor(req),
+	}
+	if len(d.Title) == 0 {
+		return nil, nil, "", badRequest("title is required")
+	}
+	if len(r.PublishDate) > 0 {
+		var err error
+		if d.Date, err = time.Parse(time.RFC3339, r.PublishDate); err != nil {
+			return nil, nil, "", badRequest("publishdate: " + err.Error())
+		}
+	}
+	if len(r.DriveFile) > 0 {
+		if s.drive == nil {
+			return nil, nil, "", &apiError{Status: http.StatusServiceUnavailable, Message: "google drive is not configured"}
+		}
+		file, err := s.drive.GetFile(r.DriveFile)
+		if err != nil {
+			return nil, nil, "", errors.New("get drivefile: " + err.Error())
+		}
+		return d, file, docxMIME, nil
+	}
+	if len(r.Document) == 0 {
+		return nil, nil, "", badRequest("document or drivefile is required")
+	}
+	mime := r.MIME
+	if len(mime) == 0 {
+		mime = docxMIME
+	}
+	return d, ioutil.NopCloser(bytes.NewReader(r.Document)), mime, nil
+}
+
+//apiStaged sets the message of the staged change ch
+//and waits for the preview to rebuild after build n
+func (s *server) apiStaged(ch *change, msg string, n uint64) (*apiChange, error) {
+	if len(msg) > 0 {
+		if err := s.hugo.SetMessage(ch.id, msg); err != nil {
+			return nil, err
+		}
+		ch.msg = msg
+	}
+	ac := s.apiChange(ch)
+	if err := s.waitForRebuild(n); err != nil {
+		ac.BuildError = err.Error()
+	}
+	return ac, nil
+}
+
+//apiRoute splits the path of an api request
+//into its resource and the rest of the path
+func apiRoute(p string) (string, []string) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(p, apiPrefix), "/"), "/")
+	return parts[0], parts[1:]
+}
+
+//methodNotAllowed returns a 405 api error for the allowed methods
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) error {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	return &apiError{Status: http.StatusMethodNotAllowed, Message: "method not allowed"}
+}
+
+//handleAPI serves the json api. Requests changing state
+//must have a json content type which browsers won't send
+//cross site without a preflight request we don't answer
+func (s *server) handleAPI(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if ct != "application/json" {
+			writeAPIError(w, &apiError{Status: http.StatusUnsupportedMediaType, Message: "content type must be application/json"})
+			return
+		}
+	}
+	var err error
+	resource, rest := apiRoute(req.URL.Path)
+	switch {
+	case resource == "posts" && len(rest) == 0:
+		err = s.apiPosts(w, req)
+	case resource == "posts" && len(rest) == 1:
+		err = s.apiPostByName(w, req, rest[0])
+	case resource == "changes" && len(rest) == 0:
+		if req.Method != http.MethodGet {
+			err = methodNotAllowed(w, http.MethodGet)
+			break
+		}
+		changes := []*apiChange{}
+		for _, c := range s.hugo.Changes() {
+			changes = append(changes, s.apiChange(c))
+		}
+		writeJSON(w, http.StatusOK, changes)
+	case resource == "changes" && len(rest) == 1:
+		err = s.apiChangeByID(w, req, rest[0])
+	case resource == "changes" && len(rest) == 2:
+		err = s.apiChangeAction(w, req, rest[0], rest[1])
+	case resource == "scheduled" && len(rest) == 0:
+		if req.Method != http.MethodGet {
+			err = methodNotAllowed(w, http.MethodGet)
+			break
+		}
+		scheduled := []*apiScheduled{}
+		for _, p := range s.scheduler.Queue() {
+			scheduled = append(scheduled, newAPIScheduled(p))
+		}
+		writeJSON(w, http.StatusOK, scheduled)
+	case resource == "scheduled" && len(rest) == 1:
+		err = s.apiScheduledByID(w, req, rest[0])
+	case resource == "drive" && len(rest) == 1 && rest[0] == "files":
+		err = s.apiDriveFiles(w, req)
+	default:
+		err = &apiError{Status: http.StatusNotFound, Message: "no such api route " + req.URL.Path}
+	}
+	if err != nil {
+		writeAPIError(w, err)
+	}
+}
+
+//apiPosts lists and creates posts
+func (s *server) apiPosts(w http.ResponseWriter, req *http.Request) error {
+	switch req.Method {
+	case http.MethodGet:
+		posts, err := s.hugo.Posts()
+		if err != nil {
+			return err
+		}
+		res := make([]*apiPost, len(posts))
+		for i, p := range posts {
+			res[i] = s.apiPost(p, false)
+		}
+		writeJSON(w, http.StatusOK, res)
+	case http.MethodPost:
+		r := new(apiPostRequest)
+		if err := decodeAPIRequest(req, r); err != nil {
+			return err
+		}
+		d, file, mime, err := s.apiDetails(req, r)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		builds := s.hugo.Builds()
+		ch, err := s.hugo.New(file, mime, d)
+		if err != nil {
+			return err
+		}
+		ac, err := s.apiStaged(ch, r.Message, builds)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, ac)
+	default:
+		return methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+	return nil
+}
+
+//apiPostByName gets, updates and deletes post name
+func (s *server) apiPostByName(w http.ResponseWriter, req *http.Request, name string) error {
+	switch req.Method {
+	case http.MethodGet:
+		p, err := s.hugo.GetPost(name)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, s.apiPost(p, true))
+	case http.MethodPut:
+		r := new(apiPostRequest)
+		if err := decodeAPIRequest(req, r); err != nil {
+			return err
+		}
+		d, file, mime, err := s.apiDetails(req, r)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		builds := s.hugo.Builds()
+		ch, err := s.hugo.Update(file, mime, name, d)
+		if err != nil {
+			return err
+		}
+		ac, err := s.apiStaged(ch, r.Message, builds)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, ac)
+	case http.MethodDelete:
+		builds := s.hugo.Builds()
+		ch, err := s.hugo.Delete(name, gitAuthor(req))
+		if err != nil {
+			return err
+		}
+		ac, err := s.apiStaged(ch, "", builds)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, ac)
+	default:
+		return methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+	return nil
+}
+
+//apiChangeByID gets change id or sets its commit message
+func (s *server) apiChangeByID(w http.ResponseWriter, req *http.Request, id string) error {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		r := new(struct {
+			Message string `json:"message"`
+		})
+		if err := decodeAPIRequest(req, r); err != nil {
+			return err
+		}
+		if len(strings.TrimSpace(r.Message)) == 0 {
+			return badRequest("message is required")
+		}
+		if err := s.hugo.SetMessage(id, r.Message); err != nil {
+			return err
+		}
+	default:
+		return methodNotAllowed(w, http.MethodGet, http.MethodPut)
+	}
+	ch, err := s.hugo.Change(id)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, s.apiChange(ch))
+	return nil
+}
+
+//apiChangeAction publishes or aborts change id
+func (s *server) apiChangeAction(w http.ResponseWriter, req *http.Request, id, action string) error {
+	if action != "publish" && action != "abort" {
+		return &apiError{Status: http.StatusNotFound, Message: "no such change action " + action}
+	}
+	if req.Method != http.MethodPost {
+		return methodNotAllowed(w, http.MethodPost)
+	}
+	ch, err := s.hugo.Change(id)
+	if err != nil {
+		return err
+	}
+	if action == "abort" {
+		if err = s.hugo.Abort(ch.id); err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, s.apiChange(ch))
+		return nil
+	}
+	published, err := s.publishChange(ch)
+	if err != nil {
+		return err
+	}
+	res := &apiPublishResponse{Post: ch.name, PullRequest: published.PullRequest}
+	res.Results, res.PostPush = published.actionResults()
+	if res.Results == nil {
+		res.Results = []*actionResult{}
+	}
+	status := http.StatusOK
+	if sp := published.Scheduled; sp != nil {
+		res.Scheduled = &sp.At
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, res)
+	return nil
+}
+
+//apiScheduledByID gets or cancels the scheduled post id
+func (s *server) apiScheduledByID(w http.ResponseWriter, req *http.Request, id string) error {
+	switch req.Method {
+	case http.MethodGet:
+		for _, p := range s.scheduler.Queue() {
+			if p.ID == id {
+				writeJSON(w, http.StatusOK, newAPIScheduled(p))
+				return nil
+			}
+		}
+		return fmt.Errorf("%w %s", errNotScheduled, id)
+	case http.MethodDelete:
+		p, err := s.scheduler.Cancel(id)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, newAPIScheduled(p))
+	default:
+		return methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+	return nil
+}
+
+//apiDriveFiles lists the google drive documents
+func (s *server) apiDriveFiles(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return methodNotAllowed(w, http.MethodGet)
+	}
+	if s.drive == nil {
+		return &apiError{Status: http.StatusServiceUnavailable, Message: "google drive is not configured"}
+	}
+	files, err := s.drive.ListFiles()
+	if err != nil {
+		return err
+	}
+	res := make([]*apiDriveFile, len(files))
+	for i, f := range files {
+		res[i] = &apiDriveFile{ID: f.Id, Name: f.Name, MIMEType: f.MimeType, Modified: f.ModifiedTime}
+	}
+	writeJSON(w, http.StatusOK, res)
+	return nil
+}
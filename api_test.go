@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+//apiRequest sends a json api request returning the response
+func apiRequest(t *testing.T, handler http.Handler, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+//decodeAPIResponse decodes the json body of w into v
+func decodeAPIResponse(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected json response got %s: %s", ct, w.Body)
+	}
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIPosts(t *testing.T) {
+	s, handler := testServer(t)
+
+	w := apiRequest(t, handler, http.MethodPost, "/api/v1/posts", map[string]interface{}{
+		"title":    "API Post",
+		"tags":     []string{"Go", "api"},
+		"document": []byte("not really a docx"),
+		"message":  "api post",
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create returned %d: %s", w.Code, w.Body)
+	}
+	created := new(apiChange)
+	decodeAPIResponse(t, w, created)
+	if created.Post != "api-post" || created.Message != "api post" || created.URL != "/post/api-post/" {
+		t.Errorf("unexpected created change %+v", created)
+	}
+
+	var posts []*apiPost
+	decodeAPIResponse(t, apiRequest(t, handler, http.MethodGet, "/api/v1/posts", nil), &posts)
+	if len(posts) != 2 {
+		t.Fatalf("expected 2 posts got %d", len(posts))
+	}
+
+	p := new(apiPost)
+	decodeAPIResponse(t, apiRequest(t, handler, http.MethodGet, "/api/v1/posts/api-post", nil), p)
+	if p.Title != "API Post" || len(p.Tags) != 2 || p.Tags[0] != "go" || p.Change != created.ID {
+		t.Errorf("unexpected post %+v", p)
+	}
+
+	//publish then delete the post
+	w = apiRequest(t, handler, http.MethodPost, "/api/v1/changes/"+created.ID+"/publish", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("publish returned %d: %s", w.Code, w.Body)
+	}
+	w = apiRequest(t, handler, http.MethodDelete, "/api/v1/posts/api-post", nil)
+	deleted := new(apiChange)
+	decodeAPIResponse(t, w, deleted)
+	if w.Code != http.StatusOK || len(deleted.Deletes) != 1 || deleted.Deletes[0] != "content/post/api-post.md" {
+		t.Fatalf("unexpected delete response %d %+v", w.Code, deleted)
+	}
+	if _, err := os.Stat(path.Join(s.hugo.path, "content/post/api-post.md")); !os.IsNotExist(err) {
+		t.Error("deleted post still in preview")
+	}
+	if w = apiRequest(t, handler, http.MethodPost, "/api/v1/changes/"+deleted.ID+"/publish", nil); w.Code != http.StatusOK {
+		t.Fatalf("publish delete returned %d: %s", w.Code, w.Body)
+	}
+	repo, err := s.hugo.repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := s.hugo.repo.CommitObject(repo.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = commit.File("content/post/api-post.md"); err == nil {
+		t.Error("deleted post still committed")
+	}
+	if w = apiRequest(t, handler, http.MethodGet, "/api/v1/posts/api-post", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected deleted post to be not found got %d", w.Code)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	_, handler := testServer(t)
+	for _, c := range []struct {
+		method, path string
+		body         interface{}
+		status       int
+	}{
+		{http.MethodGet, "/api/v1/posts/missing", nil, http.StatusNotFound},
+		{http.MethodGet, "/api/v1/changes/missing", nil, http.StatusNotFound},
+		{http.MethodPost, "/api/v1/changes/missing/abort", nil, http.StatusNotFound},
+		{http.MethodGet, "/api/v1/changes/missing/publish", nil, http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/v1/posts", map[string]string{"summary": "no title"}, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/posts", map[string]string{"title": "no document"}, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/posts", map[string]string{"unknown": "field"}, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/drive/files", nil, http.StatusServiceUnavailable},
+		{http.MethodGet, "/api/v1/unknown", nil, http.StatusNotFound},
+	} {
+		w := apiRequest(t, handler, c.method, c.path, c.body)
+		res := make(map[string]*apiError)
+		decodeAPIResponse(t, w, &res)
+		if w.Code != c.status || res["error"] == nil || res["error"].Status != c.status || len(res["error"].Message) == 0 {
+			t.Errorf("%s %s: expected error status %d got %d %s", c.method, c.path, c.status, w.Code, w.Body)
+		}
+	}
+
+	//forms can't post to the api cross site
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/posts", bytes.NewReader([]byte("title=x")))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected form post to be rejected got %d", w.Code)
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	_, handler := testAuthServer(t)
+	for password, status := range map[string]int{
+		"":       http.StatusUnauthorized,
+		"wrong":  http.StatusUnauthorized,
+		"secret": http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/changes", nil)
+		if len(password) > 0 {
+			req.SetBasicAuth("alice", password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != status {
+			t.Errorf("password %q: expected status %d got %d", password, status, w.Code)
+		}
+	}
+}
+
+func TestAPIScheduled(t *testing.T) {
+	s, handler := testServer(t)
+	sp := &scheduledPost{Name: "later", Msg: "published later", At: time.Now().Add(time.Hour)}
+	if err := s.scheduler.Add(sp); err != nil {
+		t.Fatal(err)
+	}
+	var scheduled []*apiScheduled
+	decodeAPIResponse(t, apiRequest(t, handler, http.MethodGet, "/api/v1/scheduled", nil), &scheduled)
+	if len(scheduled) != 1 || scheduled[0].ID != sp.ID || scheduled[0].Post != "later" {
+		t.Fatalf("unexpected scheduled posts %+v", scheduled)
+	}
+	if w := apiRequest(t, handler, http.MethodDelete, "/api/v1/scheduled/"+sp.ID, nil); w.Code != http.StatusOK {
+		t.Fatalf("cancel returned %d: %s", w.Code, w.Body)
+	}
+	if len(s.scheduler.Queue()) != 0 {
+		t.Error("cancelled post still queued")
+	}
+	if w := apiRequest(t, handler, http.MethodDelete, "/api/v1/scheduled/"+sp.ID, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected cancelling twice to return 404 got %d", w.Code)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//sessionCookie is the name of the session cookie
+const sessionCookie = "blogposter_session"
+
+//sessionTTL is how long a user stays signed in
+const sessionTTL = 7 * 24 * time.Hour
+
+//User is a user of the cms
+type User struct {
+	Username string `json:"username"`
+	//PasswordHash is a bcrypt hash of the user's password
+	//e.g. from htpasswd -nbBC 10 "" password
+	PasswordHash string `json:"passwordhash"`
+	//Author name put on the user's posts
+	Author string `json:"author"`
+	//GitName and GitEmail author the user's commits.
+	//GitName defaults to the username
+	GitName  string `json:"gitname"`
+	GitEmail string `json:"gitemail"`
+}
+
+//Identity returns the git identity of the user or
+//nil if the user doesn't have a git email set
+func (u *User) Identity() *Identity {
+	if len(u.GitEmail) == 0 {
+		return nil
+	}
+	name := u.GitName
+	if len(name) == 0 {
+		name = u.Username
+	}
+	return &Identity{Name: name, Email: u.GitEmail}
+}
+
+//userKey is the request context key of the signed in user
+type userKey struct{}
+
+//requestUser returns the signed in user of req or nil
+func requestUser(req *http.Request) *User {
+	u, _ := req.Context().Value(userKey{}).(*User)
+	return u
+}
+
+//session is a signed in user
+type session struct {
+	user    *User
+	expires time.Time
+}
+
+//sessions holds the signed in users keyed by session token
+type sessions struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessions() *sessions {
+	return &sessions{sessions: make(map[string]*session)}
+}
+
+//New starts a session for u returning its token
+func (s *sessions) New(u *User) string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("new session: " + err.Error())
+	}
+	token := hex.EncodeToString(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	//drop expired sessions
+	now := time.Now()
+	for t, ss := range s.sessions {
+		if now.After(ss.expires) {
+			delete(s.sessions, t)
+		}
+	}
+	s.sessions[token] = &session{user: u, expires: now.Add(sessionTTL)}
+	return token
+}
+
+//User returns the user of session token or nil
+func (s *sessions) User(token string) *User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss, ok := s.sessions[token]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(ss.expires) {
+		delete(s.sessions, token)
+		return nil
+	}
+	return ss.user
+}
+
+//Delete ends session token
+func (s *sessions) Delete(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+    <head>
+        <meta charset="UTF-8">
+        <meta name="viewport" content="width=device-width, initial-scale=1.0">
+        <title>Sign In</title>
+    </head>
+    <body>
+        <h1>Sign In</h1>
+        {{ if .Failed }}<p>Incorrect username or password</p>{{ end }}
+        <form action="/login" method="post">
+            <input type="hidden" name="next" value="{{.Next}}">
+            <input type="hidden" name="csrf" value="{{.CSRF}}">
+            <label>Username <input type="text" name="username" autofocus></label>
+            <label>Password <input type="password" name="password"></label>
+            <input type="submit" value="Sign In">
+        </form>
+    </body>
+</html>`))
+
+//LoginForm is the data for the login page
+type LoginForm struct {
+	Next   string
+	Failed bool
+	CSRF   string
+}
+
+//authEnabled reports whether users must sign in
+func (s *server) authEnabled() bool {
+	return len(s.config.Users) > 0 || len(s.config.TrustedHeader) > 0
+}
+
+//findUser returns the configured user named username or nil
+func (s *server) findUser(username string) *User {
+	for _, u := range s.config.Users {
+		if u.Username == username {
+			return u
+		}
+	}
+	return nil
+}
+
+//trustedProxy reports whether req came from a trusted proxy
+func (s *server) trustedProxy(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, p := range s.config.TrustedProxies {
+		if _, cidr, err := net.ParseCIDR(p); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+		} else if p == host {
+			return true
+		}
+	}
+	return false
+}
+
+//authenticate returns the user signed in to req. Users
+//named in the trusted header by a trusted proxy don't
+//need to be configured. Scripts can use basic auth
+func (s *server) authenticate(req *http.Request) *User {
+	if len(s.config.TrustedHeader) > 0 && s.trustedProxy(req) {
+		if name := req.Header.Get(s.config.TrustedHeader); len(name) > 0 {
+			if u := s.findUser(name); u != nil {
+				return u
+			}
+			return &User{Username: name}
+		}
+	}
+	if name, password, ok := req.BasicAuth(); ok {
+		u := s.findUser(name)
+		if u == nil || bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+			log.Printf("failed basic auth for %q from %s\n", name, req.RemoteAddr)
+			return nil
+		}
+		return u
+	}
+	if c, err := req.Cookie(sessionCookie); err == nil {
+		return s.sessions.User(c.Value)
+	}
+	return nil
+}
+
+//requireAuth wraps the cms routes in mux requiring a signed
+//in user. The preview pages are public if configured
+func (s *server) requireAuth(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !s.authEnabled() {
+			mux.ServeHTTP(w, req)
+			return
+		}
+		switch req.URL.Path {
+		case "/login", "/logout", "/healthz":
+			mux.ServeHTTP(w, req)
+			return
+		}
+		if u := s.authenticate(req); u != nil {
+			mux.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), userKey{}, u)))
+			return
+		}
+		//everything not routed to a cms handler is a preview page
+		if _, pattern := mux.Handler(req); pattern == "/" && s.config.PublicPreview {
+			mux.ServeHTTP(w, req)
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, apiPrefix) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="blogposter"`)
+			writeAPIError(w, &apiError{Status: http.StatusUnauthorized, Message: "sign in required"})
+			return
+		}
+		if req.Method != http.MethodGet {
+			http.Error(w, "sign in required", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, req, "/login?next="+url.QueryEscape(req.URL.RequestURI()), http.StatusSeeOther)
+	})
+}
+
+//safeRedirect returns next if it is a path on this
+//site otherwise the site root
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+//handleLogin signs users in. Sign in forms must submit
+//the csrf token of their cookie so other sites can't sign
+//users in to an account of theirs
+func (s *server) handleLogin(w http.ResponseWriter, req *http.Request) {
+	form := &LoginForm{Next: safeRedirect(req.FormValue("next")), CSRF: csrfToken(req)}
+	if req.Method == http.MethodPost {
+		if c, err := req.Cookie(csrfCookie); err != nil || !validCSRF(c.Value, req) {
+			log.Printf("rejected sign in from %s with missing or invalid csrf token\n", req.RemoteAddr)
+			http.Error(w, "invalid csrf token", http.StatusForbidden)
+			return
+		}
+		u := s.findUser(req.FormValue("username"))
+		if u != nil && bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(req.FormValue("password"))) == nil {
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    s.sessions.New(u),
+				Path:     "/",
+				Expires:  time.Now().Add(sessionTTL),
+				HttpOnly: true,
+				Secure:   req.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, req, form.Next, http.StatusSeeOther)
+			return
+		}
+		log.Printf("failed sign in for %q from %s\n", req.FormValue("username"), req.RemoteAddr)
+		form.Failed = true
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	serverError("error executing template", w, loginPage.Execute(w, form))
+}
+
+//handleLogout signs users out
+func (s *server) handleLogout(w http.ResponseWriter, req *http.Request) {
+	if c, err := req.Cookie(sessionCookie); err == nil {
+		s.sessions.Delete(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, req, "/login", http.StatusSeeOther)
+}
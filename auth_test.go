@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//testAuthServer returns a test server with a user
+//named alice with password secret
+func testAuthServer(t *testing.T) (*server, http.Handler) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := testServer(t)
+	s.config.Users = []*User{{Username: "alice", PasswordHash: string(hash)}}
+	return s, s.handler()
+}
+
+//login signs in with password returning the session cookie
+func login(t *testing.T, handler http.Handler, username, password string) *http.Cookie {
+	form := url.Values{"username": {username}, "password": {password}, "next": {"/changes"}}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, postRequest("/login", form))
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			if loc := w.Header().Get("Location"); loc != "/changes" {
+				t.Errorf("expected redirect to next page got %q", loc)
+			}
+			return c
+		}
+	}
+	return nil
+}
+
+func TestLoginCSRF(t *testing.T) {
+	_, handler := testAuthServer(t)
+	form := url.Values{"username": {"alice"}, "password": {"secret"}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected sign in without a csrf token to be rejected got %d", w.Code)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			t.Error("signed in without a csrf token")
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	_, handler := testAuthServer(t)
+	get := func(path string, c *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if c != nil {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	//cms routes redirect to the login page
+	w := get("/changes", nil)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login?next=%2Fchanges" {
+		t.Errorf("expected redirect to login got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if w = get("/healthz", nil); w.Code == http.StatusSeeOther {
+		t.Error("health check requires sign in")
+	}
+
+	if c := login(t, handler, "alice", "wrong"); c != nil {
+		t.Error("signed in with wrong password")
+	}
+	if c := login(t, handler, "bob", "secret"); c != nil {
+		t.Error("signed in as unknown user")
+	}
+	c := login(t, handler, "alice", "secret")
+	if c == nil {
+		t.Fatal("no session cookie set on sign in")
+	}
+	if !c.HttpOnly {
+		t.Error("session cookie readable by scripts")
+	}
+	if w = get("/changes", c); w.Code != http.StatusOK {
+		t.Errorf("expected signed in user to see changes got %d", w.Code)
+	}
+
+	//signing out ends the session
+	req := postRequest("/logout", url.Values{})
+	req.AddCookie(c)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if w = get("/changes", c); w.Code != http.StatusSeeOther {
+		t.Errorf("expected session to end on sign out got %d", w.Code)
+	}
+}
+
+func TestTrustedHeader(t *testing.T) {
+	s, handler := testAuthServer(t)
+	s.config.TrustedHeader = "X-Forwarded-User"
+	s.config.TrustedProxies = []string{"10.0.0.0/8"}
+	for addr, code := range map[string]int{
+		"10.1.2.3:4567":    http.StatusOK,
+		"192.168.1.1:4567": http.StatusSeeOther,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/changes", nil)
+		req.RemoteAddr = addr
+		req.Header.Set("X-Forwarded-User", "carol")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Errorf("%s: expected status %d got %d", addr, code, w.Code)
+		}
+	}
+}
+
+func TestPublicPreview(t *testing.T) {
+	s, handler := testAuthServer(t)
+	for _, public := range []bool{false, true} {
+		s.config.PublicPreview = public
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/post/original-title/", nil))
+		if public != (w.Code == http.StatusOK) {
+			t.Errorf("public preview %t: got status %d", public, w.Code)
+		}
+		//public viewers don't get cms controls
+		if strings.Contains(w.Body.String(), "/edit?post=") {
+			t.Errorf("public preview %t: cms controls shown to signed out user", public)
+		}
+	}
+	//cms routes still need a user
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/upload", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected upload to require sign in got %d", w.Code)
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	for next, expected := range map[string]string{
+		"/changes":            "/changes",
+		"https://example.com": "/",
+		"//example.com":       "/",
+		"/\\example.com":      "/",
+	} {
+		if got := safeRedirect(next); got != expected {
+			t.Errorf("safeRedirect(%q) = %q expected %q", next, got, expected)
+		}
+	}
+}
+
+func TestUserAuthorship(t *testing.T) {
+	s, handler := testAuthServer(t)
+	s.config.Author = "Site Author"
+	u := s.config.Users[0]
+	u.Author = "Alice A."
+	u.GitEmail = "alice@example.com"
+	c := login(t, handler, "alice", "secret")
+
+	req := uploadRequest(t, "Alices Post")
+	req.AddCookie(c)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("upload returned %d: %s", w.Code, w.Body)
+	}
+	p, err := s.hugo.GetPost("alices-post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.frontMatter.Author != "Alice A." {
+		t.Errorf("expected user's author got %q", p.frontMatter.Author)
+	}
+	ch := s.hugo.ChangeFor("alices-post")
+	if ch == nil || ch.author == nil || ch.author.Name != "alice" || ch.author.Email != "alice@example.com" {
+		t.Errorf("change not authored by user: %+v", ch)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+//production build modes
+const (
+	//buildDir builds the site into a local dir
+	buildDir = "dir"
+	//buildBranch builds the site into a clone of a
+	//branch of the remote and pushes it
+	buildBranch = "branch"
+)
+
+//BuildConfig configures the production build
+//run when a change is published
+type BuildConfig struct {
+	//Mode is dir or branch. Empty disables building
+	Mode string `json:"mode"`
+	//Dir the site is built into relative to the working
+	//dir. In branch mode it is a clone of Branch and is
+	//created if it doesn't exist
+	Dir string `json:"dir"`
+	//Branch of the remote the site is pushed to e.g. gh-pages.
+	//The branch must already exist
+	Branch string `json:"branch"`
+}
+
+//Validate checks the build config is complete
+func (c *BuildConfig) Validate() error {
+	switch c.Mode {
+	case "":
+		return nil
+	case buildDir, buildBranch:
+	default:
+		return fmt.Errorf("unknown build mode: %s", c.Mode)
+	}
+	if len(c.Dir) == 0 {
+		return errors.New("build dir is not set")
+	}
+	if c.Mode == buildBranch && len(c.Branch) == 0 {
+		return errors.New("build branch is not set")
+	}
+	return nil
+}
+
+//buildSite runs a production hugo build of the worktree
+//into the build dir. In branch mode the output is then
+//committed with msg. The caller must hold h.mu and have
+//reset the worktree to the commit being built
+func (h *HugoRepo) buildSite(msg string) error {
+	dir, err := filepath.Abs(h.build.Dir)
+	if err != nil {
+		return err
+	}
+	var site *git.Repository
+	if h.build.Mode == buildBranch {
+		if site, err = h.siteRepo(dir); err != nil {
+			return errors.New("site repo: " + err.Error())
+		}
+		//hugo can't clean the destination without
+		//removing the clone's .git dir
+		if err = cleanDir(dir, ".git"); err != nil {
+			return err
+		}
+	}
+
+	args := []string{"--minify", "--destination", dir}
+	if h.build.Mode == buildDir {
+		args = append(args, "--cleanDestinationDir")
+	}
+	if len(h.preview.environment) > 0 {
+		args = append(args, "--environment", h.preview.environment)
+	}
+	cmd := exec.Command(h.preview.bin, args...)
+	cmd.Dir = h.path
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("hugo build failed: %s\n%s", err, out)
+	}
+
+	if site == nil {
+		return nil
+	}
+	return h.commitSite(site, msg)
+}
+
+//siteRepo opens the clone of the build branch in dir
+//cloning it from the origin remote if it doesn't exist
+func (h *HugoRepo) siteRepo(dir string) (*git.Repository, error) {
+	branch := plumbing.NewBranchReferenceName(h.build.Branch)
+	site, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		remote, err := h.repo.Remote("origin")
+		if err != nil {
+			return nil, err
+		}
+		return git.PlainClone(dir, false, &git.CloneOptions{
+			URL:           remote.Config().URLs[0],
+			ReferenceName: branch,
+			SingleBranch:  true,
+			Auth:          h.auth,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	wt, err := site.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	err = wt.Pull(&git.PullOptions{RemoteName: "origin", ReferenceName: branch, SingleBranch: true, Auth: h.auth})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, errors.New("git pull: " + err.Error())
+	}
+	return site, nil
+}
+
+//commitSite commits all changes to the built site
+func (h *HugoRepo) commitSite(site *git.Repository, msg string) error {
+	wt, err := site.Worktree()
+	if err != nil {
+		return err
+	}
+	st, err := wt.Status()
+	if err != nil {
+		return err
+	}
+	if st.IsClean() {
+		return nil
+	}
+	for fname, s := range st {
+		if s.Worktree == git.Deleted {
+			_, err = wt.Remove(fname)
+		} else {
+			_, err = wt.Add(fname)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = wt.Commit(msg, &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  h.name,
+			Email: h.email,
+			When:  time.Now(),
+		},
+	})
+	if err != nil {
+		return errors.New("error committing site: " + err.Error())
+	}
+	return nil
+}
+
+//pushSite pushes the built site in branch mode
+func (h *HugoRepo) pushSite() error {
+	if h.build == nil || h.build.Mode != buildBranch {
+		return nil
+	}
+	site, err := git.PlainOpen(h.build.Dir)
+	if err != nil {
+		return err
+	}
+	err = site.PushContext(context.TODO(), &git.PushOptions{Auth: h.auth})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+//cleanDir removes everything in dir except keep
+func cleanDir(dir, keep string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Name() == keep {
+			continue
+		}
+		if err = os.RemoveAll(path.Join(dir, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
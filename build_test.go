@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+//fakeHugo writes the posts in the content dir to
+//index.html in the --destination dir and fails if
+//there is a post named broken
+const fakeHugo = `#!/bin/sh
+while [ $# -gt 0 ]; do
+    if [ "$1" = "--destination" ]; then dest=$2; fi
+    shift
+done
+if [ -f content/post/broken.md ]; then
+    echo "Error: broken post" >&2
+    exit 1
+fi
+mkdir -p "$dest" && ls content/post > "$dest/index.html"
+`
+
+//testBuildRepo returns a test repo which builds
+//with fakeHugo in mode
+func testBuildRepo(t *testing.T, mode string) *HugoRepo {
+	h := testRepo(t)
+	bin := path.Join(path.Dir(h.path), "hugo")
+	if err := ioutil.WriteFile(bin, []byte(fakeHugo), 0755); err != nil {
+		t.Fatal(err)
+	}
+	h.preview.bin = bin
+	h.build = &BuildConfig{Mode: mode, Dir: path.Join(path.Dir(h.path), "public"), Branch: "gh-pages"}
+	return h
+}
+
+func TestBuildDir(t *testing.T) {
+	h := testBuildRepo(t, buildDir)
+	pending, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Pending"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Built"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.Publish(ch.id); err != nil {
+		t.Fatal("error publishing: ", err)
+	}
+	b, err := ioutil.ReadFile(path.Join(h.build.Dir, "index.html"))
+	if err != nil {
+		t.Fatal("site not built: ", err)
+	}
+	if string(b) != "built.md\noriginal-title.md\n" {
+		t.Errorf("site built with unexpected posts:\n%s", b)
+	}
+	if _, err = h.GetPost("pending"); err != nil {
+		t.Errorf("pending post not restored after build: %s", err)
+	}
+
+	//a failed build drops the commit and keeps the change
+	head, _ := h.repo.Head()
+	broken, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Broken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.Publish(broken.id); err == nil || !strings.Contains(err.Error(), "broken post") {
+		t.Fatalf("expected build error got %v", err)
+	}
+	if after, _ := h.repo.Head(); after.Hash() != head.Hash() {
+		t.Error("commit of failed build was kept")
+	}
+	if _, err = h.Change(broken.id); err != nil {
+		t.Errorf("change of failed build removed: %s", err)
+	}
+	if _, err = h.Change(pending.id); err != nil {
+		t.Errorf("pending change removed: %s", err)
+	}
+}
+
+//addSiteBranch creates the site branch on the origin
+//of h returning the origin
+func addSiteBranch(t *testing.T, h *HugoRepo) *git.Repository {
+	remote, err := h.repo.Remote("origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin, err := git.PlainOpen(remote.Config().URLs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := origin.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = origin.Storer.SetReference(plumbing.NewHashReference("refs/heads/gh-pages", head.Hash())); err != nil {
+		t.Fatal(err)
+	}
+	return origin
+}
+
+func TestBuildBranch(t *testing.T) {
+	h := testBuildRepo(t, buildBranch)
+	addSiteBranch(t, h)
+
+	ch, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Built"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.Publish(ch.id); err != nil {
+		t.Fatal("error publishing: ", err)
+	}
+	site, err := git.PlainOpen(h.build.Dir)
+	if err != nil {
+		t.Fatal("site branch not cloned: ", err)
+	}
+	ref, err := site.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := site.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Name() != "refs/heads/gh-pages" || commit.Message != ch.msg {
+		t.Errorf("unexpected site commit %s on %s", commit.Message, ref.Name())
+	}
+	//the source files of the branch are replaced by the build
+	files, err := commit.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	files.ForEach(func(f *object.File) error {
+		names = append(names, f.Name)
+		return nil
+	})
+	if len(names) != 1 || names[0] != "index.html" {
+		t.Errorf("unexpected files in site commit: %v", names)
+	}
+}
+
+func TestBuildConfigValidate(t *testing.T) {
+	for _, c := range []*BuildConfig{
+		{Mode: "ftp", Dir: "public"},
+		{Mode: buildDir},
+		{Mode: buildBranch, Dir: "public"},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected error validating %+v", c)
+		}
+	}
+	if err := (&BuildConfig{Mode: buildBranch, Dir: "public", Branch: "gh-pages"}).Validate(); err != nil {
+		t.Errorf("unexpected error validating branch config: %s", err)
+	}
+}
+
+func TestSitePushFailure(t *testing.T) {
+	h := testBuildRepo(t, buildBranch)
+	origin := addSiteBranch(t, h)
+	initial, err := origin.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//push to the local origin
+	h.test = false
+	first, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "First"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.Publish(first.id); err != nil {
+		t.Fatal("error publishing: ", err)
+	}
+
+	//a stale branch in the site clone makes its push rejected
+	//after the build has pulled the site branch
+	pages, err := origin.Reference("refs/heads/gh-pages", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = origin.Storer.SetReference(plumbing.NewHashReference("refs/heads/stale", pages.Hash())); err != nil {
+		t.Fatal(err)
+	}
+	site, err := git.PlainOpen(h.build.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = site.Storer.SetReference(plumbing.NewHashReference("refs/heads/stale", initial.Hash())); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.Publish(ch.id); !errors.Is(err, errSitePush) {
+		t.Fatalf("expected site push error got %v", err)
+	}
+	//the post is live and no longer pending
+	head, err := origin.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := origin.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = commit.File("content/post/second.md"); err != nil {
+		t.Errorf("post not pushed to origin: %s", err)
+	}
+	if _, err = h.Change(ch.id); !errors.Is(err, errNoChange) {
+		t.Errorf("published change still pending: %v", err)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+//cliCommand is a subcommand run against the local
+//repo without starting the web server. Commands using
+//the repo refuse to run while the server is using it
+type cliCommand struct {
+	usage string
+	//repo is set for commands which need the blog repo
+	repo bool
+	run  func(s *server, args []string, out io.Writer) error
+}
+
+//cliCommands are the subcommands keyed by name
+var cliCommands = map[string]*cliCommand{
+	"post new": {
+		usage: "post new --file doc.docx --title title [--tags tags] [flags]\n\tconvert a document into a new post and publish it",
+		repo:  true,
+		run:   cliPostNew,
+	},
+	"post update": {
+		usage: "post update <name> --file doc.docx [flags]\n\treplace a post's content and publish it",
+		repo:  true,
+		run:   cliPostUpdate,
+	},
+	"post list": {
+		usage: "post list\n\tlist the posts in the repo",
+		repo:  true,
+		run:   cliPostList,
+	},
+	"publish": {
+		usage: "publish [--all]\n\tpublish the scheduled posts which are due",
+		repo:  true,
+		run:   cliPublish,
+	},
+	"schedule list": {
+		usage: "schedule list\n\tlist the scheduled posts",
+		repo:  true,
+		run:   cliScheduleList,
+	},
+	"schedule cancel": {
+		usage: "schedule cancel <id>\n\tstop a scheduled post from being published",
+		repo:  true,
+		run:   cliScheduleCancel,
+	},
+	"config print": {
+		usage: "config print\n\tprint the effective config with secrets redacted",
+		run:   cliConfigPrint,
+	},
+	"doctor": {
+		usage: "doctor\n\tcheck pandoc, hugo, the repo, its remote and google drive",
+		run:   cliDoctor,
+	},
+	"drive ls": {
+		usage: "drive ls\n\tlist the google drive documents",
+		run:   cliDriveLs,
+	},
+}
+
+//findCommand returns the command named by the
+//start of args and the rest of args
+func findCommand(args []string) (*cliCommand, []string) {
+	if len(args) > 1 {
+		if cmd, ok := cliCommands[args[0]+" "+args[1]]; ok {
+			return cmd, args[2:]
+		}
+	}
+	if cmd, ok := cliCommands[args[0]]; ok {
+		return cmd, args[1:]
+	}
+	return nil, nil
+}
+
+//cliUsage writes the usage of all commands to w
+func cliUsage(w io.Writer) {
+	names := make([]string, 0, len(cliCommands))
+	for name := range cliCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "usage: blogposter [flags]\n       blogposter [flags] <command> [args]\n\ncommands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", cliCommands[name].usage)
+	}
+}
+
+//runCLI runs the subcommand in args with conf
+func runCLI(ctx context.Context, conf *ServerConfig, args []string, out io.Writer) error {
+	if args[0] == "help" {
+		cliUsage(out)
+		return nil
+	}
+	cmd, rest := findCommand(args)
+	if cmd == nil {
+		cliUsage(os.Stderr)
+		return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+	}
+	s := NewServer(conf)
+	if err := s.initDrive(ctx); err != nil {
+		return err
+	}
+	if cmd.repo {
+		if err := conf.Validate(); err != nil {
+			return err
+		}
+		if err := s.initRepo(); err != nil {
+			return err
+		}
+		defer s.lock.Unlock()
+		if err := s.initScheduler(); err != nil {
+			return err
+		}
+	}
+	return cmd.run(s, rest, out)
+}
+
+//postFlags are the flags of the post new and update commands
+type postFlags struct {
+	*flag.FlagSet
+	file, drive, mime, title, tags, summary, date, timezone, message *string
+	draft                                                            *bool
+}
+
+//newPostFlags returns the post flags defaulting to
+//the front matter fm
+func newPostFlags(name string, fm *frontMatter, tz string) *postFlags {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	return &postFlags{
+		FlagSet:  fs,
+		file:     fs.String("file", "", "docx or odt document of the post"),
+		drive:    fs.String("drive", "", "id of a google drive document to use instead of --file"),
+		mime:     fs.String("mime", "", "MIME type of --file. detected from its extension or content by default"),
+		title:    fs.String("title", fm.Title, "post title"),
+		tags:     fs.String("tags", fm.TagList(), "space separated post tags"),
+		summary:  fs.String("summary", fm.Summary, "post summary"),
+		date:     fs.String("date", "", "publish date as 2006-01-02T15:04. a future date schedules the post"),
+		timezone: fs.String("timezone", tz, "IANA timezone of --date"),
+		message:  fs.String("message", "", "commit message"),
+		draft:    fs.Bool("draft", fm.Draft, "save the post as a draft"),
+	}
+}
+
+//document opens the document set by the flags
+func (f *postFlags) document(s *server) (io.ReadCloser, string, error) {
+	if len(*f.drive) > 0 {
+		if s.drive == nil {
+			return nil, "", errors.New("google drive is not configured")
+		}
+		file, err := s.drive.GetFile(*f.drive)
+		if err != nil {
+			return nil, "", errors.New("get drive file: " + err.Error())
+		}
+		return file, docxMIME, nil
+	}
+	if len(*f.file) == 0 {
+		return nil, "", errors.New("--file or --drive is required")
+	}
+	file, err := os.Open(*f.file)
+	if err != nil {
+		return nil, "", err
+	}
+	mime := *f.mime
+	if len(mime) == 0 {
+		if mime = extMIME(*f.file); len(mime) == 0 {
+			mime = sniffMIME(file)
+		}
+	}
+	return file, mime, nil
+}
+
+//details returns the post details set by the flags
+func (f *postFlags) details(s *server) (*postDetails, error) {
+	d := &postDetails{
+		Title:   strings.TrimSpace(*f.title),
+		Tags:    strings.ToLower(strings.TrimSpace(*f.tags)),
+		Summary: strings.TrimSpace(*f.summary),
+		Author:  s.config.Author,
+		Draft:   *f.draft,
+	}
+	if len(d.Title) == 0 {
+		return nil, errors.New("--title is required")
+	}
+	if len(*f.date) > 0 {
+		loc, err := time.LoadLocation(*f.timezone)
+		if err != nil {
+			return nil, errors.New("timezone: " + err.Error())
+		}
+		d.Date, err = time.ParseInLocation("2006-01-02T15:04", *f.date, loc)
+		if err != nil {
+			return nil, errors.New("publish date: " + err.Error())
+		}
+	}
+	return d, nil
+}
+
+//stage returns the change staged by stage with the
+//document and details set by the flags
+func (f *postFlags) stage(s *server, stage func(io.Reader, string, *postDetails) (*change, error)) (*change, error) {
+	d, err := f.details(s)
+	if err != nil {
+		return nil, err
+	}
+	file, mime, err := f.document(s)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	ch, err := stage(file, mime, d)
+	if err != nil {
+		return nil, err
+	}
+	if len(*f.message) > 0 {
+		if err = s.hugo.SetMessage(ch.id, *f.message); err != nil {
+			return nil, err
+		}
+		ch.msg = *f.message
+	}
+	return ch, nil
+}
+
+//cliPublishChange publishes or schedules ch writing the outcome to out.
+//The change is aborted if it can't be published so the
+//worktree is left clean
+func cliPublishChange(s *server, ch *change, out io.Writer) error {
+	res, err := s.publishChange(ch)
+	if err != nil {
+		if abortErr := s.hugo.Abort(ch.id); abortErr != nil && !errors.Is(abortErr, errNoChange) {
+			return fmt.Errorf("%s (abort: %s)", err, abortErr)
+		}
+		return err
+	}
+	if sp := res.Scheduled; sp != nil {
+		fmt.Fprintf(out, "scheduled %s to be published at %s\n", ch.name, sp.At.Format(time.RFC1123))
+		return nil
+	}
+	fmt.Fprintf(out, "%s\n", ch.msg)
+	if len(res.PullRequest) > 0 {
+		fmt.Fprintf(out, "opened pull request %s\n", res.PullRequest)
+	}
+	//the process exits after the command so wait
+	//for the post push actions
+	results := res.Results
+	if res.PostPush != nil {
+		results = append(results, res.PostPush.Wait()...)
+	}
+	failed := 0
+	for _, action := range results {
+		status := "ok"
+		if len(action.Err) > 0 {
+			status = "failed: " + action.Err
+			failed++
+		}
+		fmt.Fprintf(out, "post push action %s: %s\n", action.Name, status)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d post push actions failed", failed)
+	}
+	return nil
+}
+
+func cliPostNew(s *server, args []string, out io.Writer) error {
+	f := newPostFlags("post new", new(frontMatter), s.timezone())
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	ch, err := f.stage(s, s.hugo.New)
+	if err != nil {
+		return err
+	}
+	return cliPublishChange(s, ch, out)
+}
+
+func cliPostUpdate(s *server, args []string, out io.Writer) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New("usage: post update <name> [flags]")
+	}
+	name := args[0]
+	p, err := s.hugo.GetPost(name)
+	if err != nil {
+		return err
+	}
+	f := newPostFlags("post update", p.frontMatter, s.timezone())
+	if err = f.Parse(args[1:]); err != nil {
+		return err
+	}
+	ch, err := f.stage(s, func(c io.Reader, mime string, d *postDetails) (*change, error) {
+		return s.hugo.Update(c, mime, name, d)
+	})
+	if err != nil {
+		return err
+	}
+	return cliPublishChange(s, ch, out)
+}
+
+func cliPostList(s *server, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("post list", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	posts, err := s.hugo.Posts()
+	if err != nil {
+		return err
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].frontMatter.Date.After(posts[j].frontMatter.Date)
+	})
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTITLE\tDATE\tDRAFT")
+	for _, p := range posts {
+		fm := p.frontMatter
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\n", postName(p.Fname()), fm.Title, fm.Date.Format("2006-01-02 15:04"), fm.Draft)
+	}
+	return tw.Flush()
+}
+
+func cliPublish(s *server, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("publish", flag.ContinueOnError)
+	all := fs.Bool("all", false, "publish all scheduled posts now")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	now := time.Now()
+	if *all {
+		//after every queued post
+		for _, p := range s.scheduler.Queue() {
+			if p.At.After(now) {
+				now = p.At
+			}
+		}
+	}
+	published, failed := s.scheduler.publishDue(now)
+	fmt.Fprintf(out, "published %d scheduled posts. %d queued\n", published, len(s.scheduler.Queue()))
+	if failed > 0 {
+		return fmt.Errorf("%d scheduled posts failed to publish", failed)
+	}
+	return nil
+}
+
+func cliScheduleList(s *server, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("schedule list", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPOST\tPUBLISH AT\tFAILED")
+	for _, p := range s.scheduler.Queue() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.ID, p.Name, p.At.Format("2006-01-02 15:04 MST"), p.Failed)
+	}
+	return tw.Flush()
+}
+
+func cliScheduleCancel(s *server, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("schedule cancel", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("schedule cancel takes the id of a scheduled post")
+	}
+	p, err := s.scheduler.Cancel(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "cancelled publishing %s at %s\n", p.Name, p.At.Format(time.RFC1123))
+	return err
+}
+
+func cliConfigPrint(s *server, args []string, out io.Writer) error {
+	b, err := json.MarshalIndent(s.config.Redacted(), "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", b)
+	return err
+}
+
+func cliDoctor(s *server, args []string, out io.Writer) error {
+	failed := 0
+	for _, res := range preflight(context.Background(), s.config) {
+		fmt.Fprintln(out, res)
+		if res.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+func cliDriveLs(s *server, args []string, out io.Writer) error {
+	if s.drive == nil {
+		return errors.New("google drive is not configured")
+	}
+	files, err := s.drive.ListFiles()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tMODIFIED")
+	for _, f := range files {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Id, f.Name, f.ModifiedTime)
+	}
+	return tw.Flush()
+}
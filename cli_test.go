@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+//runTestCommand runs the command in args against s
+func runTestCommand(t *testing.T, s *server, args ...string) (string, error) {
+	cmd, rest := findCommand(args)
+	if cmd == nil {
+		t.Fatalf("no command %v", args)
+	}
+	out := new(bytes.Buffer)
+	err := cmd.run(s, rest, out)
+	return out.String(), err
+}
+
+func TestCLIPosts(t *testing.T) {
+	s, _ := testServer(t)
+	doc := path.Join(s.hugo.path, "..", "doc.docx")
+	if err := ioutil.WriteFile(doc, []byte("not really a docx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runTestCommand(t, s, "post", "new", "--file", doc, "--title", "CLI Post", "--tags", "Go cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "published cli-post\n" {
+		t.Errorf("unexpected post new output %q", out)
+	}
+	if files := headFiles(t, s.hugo); len(files) != 1 || files[0] != "content/post/cli-post.md" {
+		t.Errorf("expected new post to be committed got %v", files)
+	}
+
+	//unset flags keep the post's details
+	if _, err = runTestCommand(t, s, "post", "update", "cli-post", "--file", doc, "--summary", "updated"); err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.hugo.GetPost("cli-post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fm := p.frontMatter; fm.Title != "CLI Post" || fm.Summary != "updated" || strings.Join(fm.Tags, " ") != "go cli" {
+		t.Errorf("unexpected updated front matter %+v", fm)
+	}
+
+	out, err = runTestCommand(t, s, "post", "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "cli-post") || !strings.Contains(out, "original-title") {
+		t.Errorf("unexpected post list output:\n%s", out)
+	}
+
+	if _, err = runTestCommand(t, s, "post", "new", "--title", "No Document"); err == nil {
+		t.Error("expected post new without a document to fail")
+	}
+	if _, err = runTestCommand(t, s, "post", "update", "missing", "--file", doc); !os.IsNotExist(err) {
+		t.Errorf("expected updating a missing post to fail got %v", err)
+	}
+}
+
+func TestCLISchedule(t *testing.T) {
+	s, _ := testServer(t)
+	doc := path.Join(s.hugo.path, "..", "doc.docx")
+	if err := ioutil.WriteFile(doc, []byte("not really a docx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Now().Add(24 * time.Hour).Format("2006-01-02T15:04")
+	out, err := runTestCommand(t, s, "post", "new", "--file", doc, "--title", "Later", "--date", date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "scheduled later") || len(s.scheduler.Queue()) != 1 {
+		t.Fatalf("expected post to be scheduled got %q", out)
+	}
+
+	out, err = runTestCommand(t, s, "schedule", "list")
+	if id := s.scheduler.Queue()[0].ID; err != nil || !strings.Contains(out, id+"  later") {
+		t.Errorf("unexpected schedule list output %q %v", out, err)
+	}
+
+	//nothing is due yet
+	if out, err = runTestCommand(t, s, "publish"); err != nil || out != "published 0 scheduled posts. 1 queued\n" {
+		t.Errorf("unexpected publish output %q %v", out, err)
+	}
+	if out, err = runTestCommand(t, s, "publish", "--all"); err != nil || out != "published 1 scheduled posts. 0 queued\n" {
+		t.Errorf("unexpected publish --all output %q %v", out, err)
+	}
+	if files := headFiles(t, s.hugo); len(files) != 1 || files[0] != "content/post/later.md" {
+		t.Errorf("expected scheduled post to be committed got %v", files)
+	}
+	if _, err = runTestCommand(t, s, "schedule", "cancel", "missing"); !errors.Is(err, errNotScheduled) {
+		t.Errorf("expected cancelling a missing post to fail got %v", err)
+	}
+}
+
+func TestCLIUnknownCommand(t *testing.T) {
+	if err := runCLI(context.Background(), new(ServerConfig), []string{"post", "remove"}, ioutil.Discard); err == nil {
+		t.Error("expected unknown command to fail")
+	}
+	if _, err := runTestCommand(t, new(server), "drive", "ls"); err == nil {
+		t.Error("expected drive ls without drive config to fail")
+	}
+}
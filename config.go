@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+//envPrefix prefixes the environment variables of config
+//fields. Each field is set by envPrefix followed by its
+//upper cased json key e.g. BLOGPOSTER_REMOTEURL
+const envPrefix = "BLOGPOSTER_"
+
+//environment variables of the google api config
+const (
+	envKeyConfigGAPIPrivateKey   = "GAPI_PRIVATE_KEY"
+	envKeyConfigGAPIPrivateKeyID = "GAPI_PRIVATE_KEY_ID"
+	envKeyConfigGAPIEmail        = "GAPI_EMAIL"
+	envKeyConfigGAPITokenURL     = "GAPI_TOKEN_URL"
+)
+
+//envKeyConfigFile is the config file used if -config isn't set
+const envKeyConfigFile = "BLOGPOSTER_CONFIG"
+
+//redacted replaces secrets in printed configs
+const redacted = "REDACTED"
+
+//ReadServerConfig reads a json or yaml config file.
+//Files ending in .yaml or .yml are read as yaml
+func ReadServerConfig(fpath string) (*ServerConfig, error) {
+	log.Println("reading config file " + fpath)
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(path.Ext(fpath)) {
+	case ".yaml", ".yml":
+		//convert to json so both formats use the json keys
+		var v interface{}
+		if err = yaml.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+		if b, err = json.Marshal(jsonValue(v)); err != nil {
+			return nil, err
+		}
+	}
+	conf := new(ServerConfig)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(conf); err != nil {
+		return nil, fmt.Errorf("%s: %s", fpath, err)
+	}
+	return conf, nil
+}
+
+//jsonValue converts the maps in a yaml value to the
+//string keyed maps json can marshal
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+	}
+	return v
+}
+
+//LoadConfig returns the config read from the file fpath
+//if set overlaid with the environment from lookup
+func LoadConfig(fpath string, lookup func(string) (string, bool)) (*ServerConfig, error) {
+	conf := new(ServerConfig)
+	if len(fpath) > 0 {
+		var err error
+		if conf, err = ReadServerConfig(fpath); err != nil {
+			return nil, err
+		}
+	}
+	if err := conf.applyEnv(lookup); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+//configField is a config field settable from text
+type configField struct {
+	//key is the field's json key
+	key   string
+	index int
+	typ   reflect.Type
+}
+
+//configFields returns the config fields with json keys
+func configFields() []*configField {
+	t := reflect.TypeOf(ServerConfig{})
+	var fields []*configField
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if len(key) == 0 || key == "-" {
+			continue
+		}
+		fields = append(fields, &configField{key: key, index: i, typ: t.Field(i).Type})
+	}
+	return fields
+}
+
+//envKey returns the environment variable of config key
+func envKey(key string) string {
+	return envPrefix + strings.ToUpper(key)
+}
+
+//setFields sets the config fields lookup returns a value
+//for by their json key. Errors are reported for the name
+//of the key the value was set with
+func (c *ServerConfig) setFields(lookup func(key string) (string, bool), name func(key string) string) error {
+	v := reflect.ValueOf(c).Elem()
+	for _, f := range configFields() {
+		s, ok := lookup(f.key)
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(f.index), s); err != nil {
+			return fmt.Errorf("%s: %s", name(f.key), err)
+		}
+	}
+	return nil
+}
+
+//applyEnv sets the config fields set in the environment.
+//Strings, bools and ints are set from their text. Lists
+//are comma separated or json like the other fields
+func (c *ServerConfig) applyEnv(lookup func(string) (string, bool)) error {
+	err := c.setFields(func(key string) (string, bool) {
+		return lookup(envKey(key))
+	}, envKey)
+	if err != nil {
+		return err
+	}
+	for key, field := range map[string]func(*GAPIConfig) *string{
+		envKeyConfigGAPIPrivateKeyID: func(g *GAPIConfig) *string { return &g.PrivateKeyID },
+		envKeyConfigGAPIPrivateKey:   func(g *GAPIConfig) *string { return &g.PrivateKey },
+		envKeyConfigGAPIEmail:        func(g *GAPIConfig) *string { return &g.Email },
+		envKeyConfigGAPITokenURL:     func(g *GAPIConfig) *string { return &g.TokenURL },
+	} {
+		if s, ok := lookup(key); ok {
+			if c.GAPI == nil {
+				c.GAPI = new(GAPIConfig)
+			}
+			*field(c.GAPI) = s
+		}
+	}
+	return nil
+}
+
+//setField sets the config field f from the text s
+func setField(f reflect.Value, s string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			//values like yes were always true as only 0 was false
+			b = s != "0"
+		}
+		f.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(n))
+	case reflect.Slice:
+		if f.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(s), "[") {
+			var l []string
+			for _, e := range strings.Split(s, ",") {
+				if e = strings.TrimSpace(e); len(e) > 0 {
+					l = append(l, e)
+				}
+			}
+			f.Set(reflect.ValueOf(l))
+			return nil
+		}
+		fallthrough
+	default:
+		p := reflect.New(f.Type())
+		if err := json.Unmarshal([]byte(s), p.Interface()); err != nil {
+			return err
+		}
+		f.Set(p.Elem())
+	}
+	return nil
+}
+
+//configFlags are command line flags for every config field
+//named by its json key e.g. -remoteurl. The flags are parsed
+//before the config is loaded so the values are collected
+//and applied over the file and environment by apply
+type configFlags struct {
+	values map[string]string
+}
+
+//newConfigFlags defines the config flags in fs
+func newConfigFlags(fs *flag.FlagSet) *configFlags {
+	f := &configFlags{values: make(map[string]string)}
+	for _, field := range configFields() {
+		usage := fmt.Sprintf("sets %s. overrides %s", field.key, envKey(field.key))
+		switch kind := field.typ.Kind(); {
+		case kind == reflect.Slice && field.typ.Elem().Kind() == reflect.String:
+			usage += ". comma separated or json"
+		case kind == reflect.Slice, kind == reflect.Ptr:
+			usage += ". json"
+		}
+		fs.Var(&configFlag{key: field.key, values: f.values, bool: field.typ.Kind() == reflect.Bool}, field.key, usage)
+	}
+	return f
+}
+
+//apply sets the config fields of the flags which were set
+func (f *configFlags) apply(c *ServerConfig) error {
+	return c.setFields(func(key string) (string, bool) {
+		s, ok := f.values[key]
+		return s, ok
+	}, func(key string) string {
+		return "-" + key
+	})
+}
+
+//configFlag collects the value of a config flag
+type configFlag struct {
+	key    string
+	values map[string]string
+	bool   bool
+}
+
+func (f *configFlag) String() string {
+	return ""
+}
+
+func (f *configFlag) Set(s string) error {
+	f.values[f.key] = s
+	return nil
+}
+
+//IsBoolFlag lets bool fields be set without a value e.g. -test
+func (f *configFlag) IsBoolFlag() bool {
+	return f.bool
+}
+
+//Validate checks the config has the fields needed to
+//work on the blog repo and that its settings are valid
+func (c *ServerConfig) Validate() error {
+	var missing []string
+	for _, f := range []struct {
+		name, value string
+	}{
+		{"path", c.Path},
+		{"name", c.Name},
+		{"email", c.Email},
+	} {
+		if len(f.value) == 0 {
+			missing = append(missing, f.name)
+		}
+	}
+	if _, err := os.Stat(c.Path); os.IsNotExist(err) && len(c.RemoteUrl) == 0 {
+		missing = append(missing, "remoteurl (path doesn't exist so must be cloned)")
+	}
+	if len(missing) > 0 {
+		return errors.New("missing required config: " + strings.Join(missing, ", "))
+	}
+	if _, err := NewConverter(c.Converter); err != nil {
+		return err
+	}
+	if len(c.Timezone) > 0 {
+		if _, err := time.LoadLocation(c.Timezone); err != nil {
+			return errors.New("timezone: " + err.Error())
+		}
+	}
+	if err := c.gitAuth().Validate(c.remoteURL()); err != nil {
+		return errors.New("git auth: " + err.Error())
+	}
+	if c.Review != nil {
+		if err := c.Review.Validate(); err != nil {
+			return errors.New("review config: " + err.Error())
+		}
+	}
+	if c.Build != nil {
+		if err := c.Build.Validate(); err != nil {
+			return errors.New("build config: " + err.Error())
+		}
+	}
+	for i, a := range c.PostPush {
+		if err := a.Validate(); err != nil {
+			return fmt.Errorf("post push action %d: %s", i, err)
+		}
+	}
+	for i, u := range c.Users {
+		if len(u.Username) == 0 || len(u.PasswordHash) == 0 {
+			return fmt.Errorf("user %d: username and passwordhash are required", i)
+		}
+	}
+	return nil
+}
+
+//redactURL returns the scheme and host of raw. Webhook
+//urls often carry secrets in their path or query
+func redactURL(raw string) string {
+	if len(raw) == 0 {
+		return raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || len(u.Host) == 0 {
+		return redacted
+	}
+	if u.User == nil && len(strings.Trim(u.Path, "/")) == 0 && len(u.RawQuery) == 0 {
+		return raw
+	}
+	return u.Scheme + "://" + u.Host + "/" + redacted
+}
+
+//redactRemoteURL removes the credentials from a git remote
+//url keeping the repo path. scp like ssh urls are returned
+//as is as they can't hold a password
+func redactRemoteURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	u.User = nil
+	return u.String()
+}
+
+//Redacted returns a copy of the config safe to print
+//with its secrets replaced
+func (c *ServerConfig) Redacted() *ServerConfig {
+	cp := *c
+	redact := func(s *string) {
+		if len(*s) > 0 {
+			*s = redacted
+		}
+	}
+	redact(&cp.Token)
+	//https remotes may have a token as their user
+	cp.RemoteUrl = redactRemoteURL(c.RemoteUrl)
+	if c.GitAuth != nil {
+		auth := *c.GitAuth
+		redact(&auth.Password)
+		redact(&auth.SSHKeyPassphrase)
+		cp.GitAuth = &auth
+	}
+	if c.Review != nil {
+		review := *c.Review
+		redact(&review.Token)
+		cp.Review = &review
+	}
+	if c.GAPI != nil {
+		gapi := *c.GAPI
+		redact(&gapi.PrivateKey)
+		redact(&gapi.PrivateKeyID)
+		cp.GAPI = &gapi
+	}
+	if c.PostPush != nil {
+		cp.PostPush = make([]*PostPushAction, len(c.PostPush))
+		for i, a := range c.PostPush {
+			action := *a
+			action.URL = redactURL(a.URL)
+			//args may hold tokens such as curl headers
+			if len(a.Command) > 1 {
+				action.Command = []string{a.Command[0], redacted}
+			}
+			cp.PostPush[i] = &action
+		}
+	}
+	if c.Users != nil {
+		cp.Users = make([]*User, len(c.Users))
+		for i, u := range c.Users {
+			user := *u
+			redact(&user.PasswordHash)
+			cp.Users[i] = &user
+		}
+	}
+	return &cp
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+)
+
+const odtMIME = "application/vnd.oasis.opendocument.text"
+
+var PandocLoc = "pandoc"
+var lbrk = regexp.MustCompile("\\\\\n")
+var listblkqtreplace = "  -"
+var listblkqt = regexp.MustCompile(`\s\s-\s>`)
+var numlistblkqtreplace = "1."
+var numlistblkqt = regexp.MustCompile(`\d{1,3}\.\s{1,2}>`)
+var listblkqtconinuedreplace = ""
+var listblkqtcontinued = regexp.MustCompile(`\s\s\s\s>\s`)
+
+//Converter converts a document of the given
+//MIME type into markdown
+type Converter interface {
+	Convert(c io.Reader, mime string) (*Conversion, error)
+}
+
+//Conversion is the result of converting a document
+type Conversion struct {
+	//Markdown content of the document
+	Markdown []byte
+	//files extracted from the document
+	Assets []*Asset
+}
+
+//Asset is a file extracted from a document such
+//as an embedded image. Name is the path the markdown
+//uses to reference the asset
+type Asset struct {
+	Name string
+	Data []byte
+}
+
+//NewConverter returns the converter registered under
+//name. An empty name returns the pandoc converter
+func NewConverter(name string) (Converter, error) {
+	switch name {
+	case "", "pandoc":
+		return &PandocConverter{Path: PandocLoc}, nil
+	case "docx":
+		return new(DocxConverter), nil
+	default:
+		return nil, fmt.Errorf("unknown converter: %s", name)
+	}
+}
+
+//PandocConverter converts documents to commonmark
+//by shelling out to pandoc
+type PandocConverter struct {
+	//path to pandoc binary
+	Path string
+}
+
+var pandocFormats = map[string]string{
+	docxMIME: "docx",
+	odtMIME:  "odt",
+}
+
+func (p *PandocConverter) Convert(c io.Reader, mime string) (*Conversion, error) {
+	format, ok := pandocFormats[mime]
+	if !ok {
+		return nil, fmt.Errorf("pandoc: unsupported document type: %s", mime)
+	}
+	bin := p.Path
+	if len(bin) == 0 {
+		bin = PandocLoc
+	}
+	//have pandoc extract media into a temp dir
+	//so it can be returned with the conversion
+	dir, err := ioutil.TempDir("", "blogposter-media")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	outbuf := new(bytes.Buffer)
+	cmd := exec.Command(bin, "-f", format, "-t", "commonmark", "--extract-media", dir, "-o", "-")
+	log.Println(cmd.String())
+	cmd.Stdin = c
+	cmd.Stdout = outbuf
+	err = cmd.Run()
+	if err != nil {
+		switch e := err.(type) {
+		case *exec.ExitError:
+			//pandoc outputs error messages to stdout - not stderr
+			err = fmt.Errorf("%s: %s", e.Error(), outbuf.String())
+		}
+		return nil, err
+	}
+	assets, err := readAssets(dir)
+	if err != nil {
+		return nil, errors.New("read extracted media: " + err.Error())
+	}
+	b := outbuf.Bytes()
+	//make media references relative to the extraction dir
+	b = bytes.ReplaceAll(b, []byte(filepath.ToSlash(dir)+"/"), []byte{})
+	return &Conversion{Markdown: cleanPandoc(b), Assets: assets}, nil
+}
+
+//readAssets reads all files under dir as assets
+//named by their slash separated path relative to dir
+func readAssets(dir string) ([]*Asset, error) {
+	var assets []*Asset
+	err := filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		assets = append(assets, &Asset{Name: filepath.ToSlash(name), Data: b})
+		return nil
+	})
+	return assets, err
+}
+
+//cleanPandoc undoes pandoc escaping and list
+//formatting which doesn't render nicely in hugo
+func cleanPandoc(b []byte) []byte {
+	//replace gt and lt html placeholders with literals
+	b = bytes.ReplaceAll(b, []byte("&gt;"), []byte{'>'})
+	b = bytes.ReplaceAll(b, []byte("&lt;"), []byte{'<'})
+	//undo pandoc escaping of horizontal line rules
+	b = bytes.ReplaceAll(b, []byte("\\---"), []byte("---"))
+	//undo pandoc escaping of markdown line breaks
+	b = lbrk.ReplaceAll(b, []byte(""))
+	//undo pandoc making bulleted list items blockquotes
+	b = listblkqt.ReplaceAll(b, []byte(listblkqtreplace))
+	//undo pandoc making number list items blockquotes
+	b = numlistblkqt.ReplaceAll(b, []byte(numlistblkqtreplace))
+	//replace all list block quote line continuations
+	b = listblkqtcontinued.ReplaceAll(b, []byte(listblkqtconinuedreplace))
+	//undo pandoc escaping of backticks
+	b = bytes.ReplaceAll(b, []byte("\\`"), []byte("`"))
+	return b
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testDocxNS = `xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" ` +
+	`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships" ` +
+	`xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" ` +
+	`xmlns:wp="http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing"`
+
+const testDocxBody = `<?xml version="1.0" encoding="UTF-8"?>
+<w:document ` + testDocxNS + `><w:body>
+<w:p><w:pPr><w:pStyle w:val="Heading1"/></w:pPr><w:r><w:t>A Heading</w:t></w:r></w:p>
+<w:p><w:r><w:t xml:space="preserve">Some </w:t></w:r><w:r><w:rPr><w:b/></w:rPr><w:t xml:space="preserve">bold </w:t></w:r><w:r><w:rPr><w:i/></w:rPr><w:t>italic</w:t></w:r><w:r><w:t xml:space="preserve"> and a </w:t></w:r><w:hyperlink r:id="rId2"><w:r><w:t>link</w:t></w:r></w:hyperlink></w:p>
+<w:p><w:pPr><w:numPr><w:ilvl w:val="0"/><w:numId w:val="1"/></w:numPr></w:pPr><w:r><w:t>first</w:t></w:r></w:p>
+<w:p><w:pPr><w:numPr><w:ilvl w:val="1"/><w:numId w:val="1"/></w:numPr></w:pPr><w:r><w:t>nested</w:t></w:r></w:p>
+<w:p><w:pPr><w:numPr><w:ilvl w:val="0"/><w:numId w:val="2"/></w:numPr></w:pPr><w:r><w:t>ordered</w:t></w:r></w:p>
+<w:p><w:r><w:drawing><wp:inline><wp:docPr id="1" name="Picture 1" descr="a cat"/><a:graphic><a:graphicData><a:blip r:embed="rId3"/></a:graphicData></a:graphic></wp:inline></w:drawing></w:r></w:p>
+<w:p><w:r><w:t>Not *bold*, _x_ # [y] ` + "`z`" + ` &lt;b&gt;</w:t></w:r></w:p>
+<w:p><w:r><w:drawing><wp:inline><wp:docPr id="2" name="Picture 2" descr="a cat"/><a:graphic><a:graphicData><a:blip r:embed="rId3"/></a:graphicData></a:graphic></wp:inline></w:drawing></w:r></w:p>
+<w:p></w:p>
+</w:body></w:document>`
+
+const testDocxRels = `<?xml version="1.0" encoding="UTF-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/hyperlink" Target="https://example.com" TargetMode="External"/>
+<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/image" Target="media/image1.png"/>
+</Relationships>`
+
+const testDocxNumbering = `<?xml version="1.0" encoding="UTF-8"?>
+<w:numbering ` + testDocxNS + `>
+<w:abstractNum w:abstractNumId="0"><w:lvl w:ilvl="0"><w:numFmt w:val="bullet"/></w:lvl><w:lvl w:ilvl="1"><w:numFmt w:val="bullet"/></w:lvl></w:abstractNum>
+<w:abstractNum w:abstractNumId="1"><w:lvl w:ilvl="0"><w:numFmt w:val="decimal"/></w:lvl></w:abstractNum>
+<w:num w:numId="1"><w:abstractNumId w:val="0"/></w:num>
+<w:num w:numId="2"><w:abstractNumId w:val="1"/></w:num>
+</w:numbering>`
+
+var testDocxImage = []byte("\x89PNG not really")
+
+//testDocx returns a minimal docx archive
+func testDocx(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	files := map[string][]byte{
+		"word/document.xml":            []byte(testDocxBody),
+		"word/_rels/document.xml.rels": []byte(testDocxRels),
+		"word/numbering.xml":           []byte(testDocxNumbering),
+		"word/media/image1.png":        testDocxImage,
+	}
+	for name, b := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDocxConverter(t *testing.T) {
+	conv, err := new(DocxConverter).Convert(bytes.NewReader(testDocx(t)), docxMIME)
+	if err != nil {
+		t.Fatal("error converting docx: ", err)
+	}
+	expected := `# A Heading
+
+Some **bold** *italic* and a [link](https://example.com)
+
+- first
+  - nested
+
+1. ordered
+
+![a cat](media/image1.png)
+
+Not \*bold\*, \_x\_ \# \[y\] \` + "`z\\`" + ` \<b>
+
+![a cat](media/image1.png)
+`
+	if string(conv.Markdown) != expected {
+		t.Errorf("unexpected markdown:\n%s\nexpected:\n%s", conv.Markdown, expected)
+	}
+	if len(conv.Assets) != 1 {
+		t.Fatalf("expected 1 asset got %d", len(conv.Assets))
+	}
+	if a := conv.Assets[0]; a.Name != "media/image1.png" || !bytes.Equal(a.Data, testDocxImage) {
+		t.Errorf("unexpected asset %s: %q", a.Name, a.Data)
+	}
+}
+
+func TestDocxConverterUnsupportedMIME(t *testing.T) {
+	_, err := new(DocxConverter).Convert(strings.NewReader(""), "text/plain")
+	if err == nil {
+		t.Error("expected error converting unsupported document type")
+	}
+}
+
+func TestNewConverter(t *testing.T) {
+	for name, expected := range map[string]string{
+		"":       "*main.PandocConverter",
+		"pandoc": "*main.PandocConverter",
+		"docx":   "*main.DocxConverter",
+	} {
+		c, err := NewConverter(name)
+		if err != nil {
+			t.Fatalf("error getting converter %q: %s", name, err)
+		}
+		if typ := fmt.Sprintf("%T", c); typ != expected {
+			t.Errorf("expected %s for %q got %s", expected, name, typ)
+		}
+	}
+	if _, err := NewConverter("nope"); err == nil {
+		t.Error("expected error for unknown converter")
+	}
+}
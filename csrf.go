@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+//csrfCookie is the name of the cookie holding the csrf
+//token. Forms submit the same token in csrfField
+const (
+	csrfCookie = "blogposter_csrf"
+	csrfField  = "csrf"
+	//csrfHeader is accepted in place of the form field
+	csrfHeader = "X-CSRF-Token"
+)
+
+//csrfKey is the request context key of the csrf token
+type csrfKey struct{}
+
+//csrfToken returns the csrf token of req to embed in forms
+func csrfToken(req *http.Request) string {
+	t, _ := req.Context().Value(csrfKey{}).(string)
+	return t
+}
+
+//withCSRF gives every client a csrf token cookie and adds
+//the token to the request context for forms
+func withCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var token string
+		if c, err := req.Cookie(csrfCookie); err == nil && len(c.Value) > 0 {
+			token = c.Value
+		} else {
+			b := make([]byte, 32)
+			if _, err := rand.Read(b); err != nil {
+				panic("csrf token: " + err.Error())
+			}
+			token = hex.EncodeToString(b)
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookie,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   req.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), csrfKey{}, token)))
+	})
+}
+
+//stateChanging only allows POST requests to h which
+//submit the csrf token of their cookie
+func stateChanging(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c, err := req.Cookie(csrfCookie)
+		if err != nil || !validCSRF(c.Value, req) {
+			log.Printf("rejected %s from %s with missing or invalid csrf token\n", req.URL.Path, req.RemoteAddr)
+			http.Error(w, "invalid csrf token", http.StatusForbidden)
+			return
+		}
+		h(w, req)
+	}
+}
+
+//validCSRF reports whether req submitted token
+func validCSRF(token string, req *http.Request) bool {
+	submitted := req.Header.Get(csrfHeader)
+	if len(submitted) == 0 {
+		submitted = req.FormValue(csrfField)
+	}
+	return len(token) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(submitted)) == 1
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStateChangingRoutes(t *testing.T) {
+	s, handler := testServer(t)
+	ch, err := s.hugo.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Guarded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(req *http.Request) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, route := range []string{"/upload", "/replace", "/publish", "/abort", "/unschedule", "/promote", "/logout"} {
+		if code := serve(httptest.NewRequest(http.MethodGet, route+"?change="+ch.id, nil)); code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s: expected status 405 got %d", route, code)
+		}
+	}
+
+	form := url.Values{"change": {ch.id}}
+	//no token
+	req := httptest.NewRequest(http.MethodPost, "/publish", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if code := serve(req); code != http.StatusForbidden {
+		t.Errorf("expected status 403 without token got %d", code)
+	}
+	//token that doesn't match the cookie
+	req = postRequest("/publish", form)
+	req.Header.Del("Cookie")
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: "another-token"})
+	if code := serve(req); code != http.StatusForbidden {
+		t.Errorf("expected status 403 with wrong token got %d", code)
+	}
+	if _, err = s.hugo.Change(ch.id); err != nil {
+		t.Fatal("change published without a valid token")
+	}
+	if code := serve(postRequest("/publish", form)); code != http.StatusOK {
+		t.Errorf("expected publish with token to succeed got %d", code)
+	}
+}
+
+func TestCSRFTokenInPages(t *testing.T) {
+	s, handler := testServer(t)
+	if _, err := s.hugo.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Tokened"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/new", "/changes", "/login", "/post/tokened/"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var token string
+		for _, c := range w.Result().Cookies() {
+			if c.Name == csrfCookie {
+				token = c.Value
+			}
+		}
+		if len(token) == 0 {
+			t.Fatalf("%s: no csrf cookie set", path)
+		}
+		if !strings.Contains(w.Body.String(), `name="csrf" value="`+token+`"`) {
+			t.Errorf("%s: csrf token not in page: %s", path, w.Body)
+		}
+	}
+}
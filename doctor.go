@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+//minimum versions of the external binaries
+var (
+	//pandoc 2 is needed for commonmark output with extracted media
+	minPandocVersion = [2]int{2, 0}
+	//hugo 0.48 added --environment and --minify
+	minHugoVersion = [2]int{0, 48}
+)
+
+//checkTimeout limits checks which use the network
+var checkTimeout = 15 * time.Second
+
+var versionRegexp = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+//checkResult is the outcome of a preflight check
+type checkResult struct {
+	Name string
+	//Detail describes what was found e.g. a version
+	Detail string
+	Err    error
+	//Required checks stop the server starting if they fail
+	Required bool
+}
+
+//preflight checks the external dependencies of conf.
+//The config is checked first and the other checks are
+//only run if it is valid
+func preflight(ctx context.Context, conf *ServerConfig) []*checkResult {
+	res := &checkResult{Name: "config", Required: true, Err: conf.Validate()}
+	if res.Err != nil {
+		return []*checkResult{res}
+	}
+	res.Detail = "valid"
+	results := []*checkResult{res}
+	if len(conf.Converter) == 0 || conf.Converter == "pandoc" {
+		results = append(results, checkBinary("pandoc", PandocLoc, minPandocVersion, "--version"))
+	}
+	hugo := conf.HugoPath
+	if len(hugo) == 0 {
+		hugo = "hugo"
+	}
+	results = append(results, checkBinary("hugo", hugo, minHugoVersion, "version"))
+
+	h, res := checkRepo(conf)
+	results = append(results, res)
+	if h != nil {
+		remote := checkRemote(ctx, h)
+		//publishing pushes to the remote except in test mode
+		remote.Required = !conf.Test
+		results = append(results, remote, checkContentDir(h))
+	}
+	if conf.GAPI != nil && len(conf.GAPI.PrivateKeyID) > 0 {
+		results = append(results, checkDrive(ctx, conf.GAPI))
+	}
+	return results
+}
+
+//checkBinary runs bin with the version args checking
+//it reports at least version min
+func checkBinary(name, bin string, min [2]int, args ...string) *checkResult {
+	res := &checkResult{Name: name, Required: true}
+	out, err := exec.Command(bin, args...).CombinedOutput()
+	if err != nil {
+		res.Err = fmt.Errorf("running %s: %s", bin, err)
+		return res
+	}
+	res.Detail = strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	m := versionRegexp.FindStringSubmatch(res.Detail)
+	if m == nil {
+		res.Err = fmt.Errorf("no version in %q", res.Detail)
+		return res
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	if major < min[0] || (major == min[0] && minor < min[1]) {
+		res.Err = fmt.Errorf("%s is older than the minimum version %d.%d", res.Detail, min[0], min[1])
+	}
+	return res
+}
+
+//checkRepo opens the blog repo and checks it has an origin
+func checkRepo(conf *ServerConfig) (*HugoRepo, *checkResult) {
+	res := &checkResult{Name: "repo", Required: true}
+	auth, err := conf.AuthMethod()
+	if err != nil {
+		res.Err = errors.New("git auth: " + err.Error())
+		return nil, res
+	}
+	h, err := NewHugoRepo(conf.Path, auth, conf.BaseUrl, conf.Name, conf.Email)
+	if err != nil {
+		if err == git.ErrRepositoryNotExists {
+			err = fmt.Errorf("%s is not a git repo. It is cloned from remoteurl at startup", conf.Path)
+		}
+		res.Err = err
+		return nil, res
+	}
+	if len(conf.ContentDir) > 0 {
+		h.contentDir = conf.ContentDir
+	}
+	remote, err := h.repo.Remote("origin")
+	if err != nil {
+		res.Err = errors.New("origin remote: " + err.Error())
+		return nil, res
+	}
+	res.Detail = fmt.Sprintf("%s with origin %s", conf.Path, strings.Join(remote.Config().URLs, " "))
+	return h, res
+}
+
+//checkRemote lists the refs of origin to check it can be
+//reached with the configured credentials
+func checkRemote(ctx context.Context, h *HugoRepo) *checkResult {
+	res := &checkResult{Name: "remote"}
+	remote, err := h.repo.Remote("origin")
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	//List doesn't take a context so give up waiting at the timeout
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	done := make(chan int, 1)
+	go func() {
+		refs, err := remote.List(&git.ListOptions{Auth: h.auth})
+		if err != nil {
+			res.Err = err
+		}
+		done <- len(refs)
+	}()
+	select {
+	case n := <-done:
+		if res.Err == nil {
+			res.Detail = fmt.Sprintf("reachable with %d refs", n)
+		}
+		return res
+	case <-ctx.Done():
+		return &checkResult{Name: res.Name, Err: errors.New("timed out listing remote refs")}
+	}
+}
+
+//checkContentDir checks posts can be written to the content dir
+func checkContentDir(h *HugoRepo) *checkResult {
+	dir := path.Join(h.path, h.contentDir)
+	res := &checkResult{Name: "content dir", Required: true, Detail: dir + " is writable"}
+	//the content dir is created with the first post
+	for {
+		if _, err := os.Stat(dir); err == nil || !os.IsNotExist(err) || dir == h.path {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+	f, err := ioutil.TempFile(dir, ".blogposter-doctor")
+	if err != nil {
+		res.Detail = ""
+		res.Err = err
+		return res
+	}
+	f.Close()
+	res.Err = os.Remove(f.Name())
+	return res
+}
+
+//checkDrive authenticates with google drive
+func checkDrive(ctx context.Context, gapi *GAPIConfig) *checkResult {
+	res := &checkResult{Name: "google drive"}
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	d, err := NewGDriveCli(ctx, gapi)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	if _, err = d.Files.List().PageSize(1).Context(ctx).Do(); err != nil {
+		res.Err = errors.New("list files: " + err.Error())
+		return res
+	}
+	res.Detail = "authenticated as " + gapi.Email
+	return res
+}
+
+func (res *checkResult) String() string {
+	switch {
+	case res.Err == nil:
+		return fmt.Sprintf("PASS %s: %s", res.Name, res.Detail)
+	case res.Required:
+		return fmt.Sprintf("FAIL %s: %s", res.Name, res.Err)
+	}
+	return fmt.Sprintf("WARN %s: %s", res.Name, res.Err)
+}
+
+//logChecks logs the preflight results returning an error
+//if a required check failed
+func logChecks(results []*checkResult) error {
+	required := 0
+	for _, res := range results {
+		log.Printf("preflight: %s\n", res)
+		if res.Err != nil && res.Required {
+			required++
+		}
+	}
+	if required > 0 {
+		return fmt.Errorf("%d required preflight checks failed", required)
+	}
+	return nil
+}
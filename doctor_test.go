@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+//fakeVersion writes a script to dir printing version
+func fakeVersion(t *testing.T, dir, name, version string) string {
+	bin := path.Join(dir, name)
+	if err := ioutil.WriteFile(bin, []byte("#!/bin/sh\necho '"+version+"'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return bin
+}
+
+func TestPreflight(t *testing.T) {
+	h := testRepo(t)
+	dir := path.Dir(h.path)
+	pandoc := PandocLoc
+	PandocLoc = fakeVersion(t, dir, "pandoc", "pandoc 2.9.2.1")
+	t.Cleanup(func() { PandocLoc = pandoc })
+	conf := &ServerConfig{
+		Path:     h.path,
+		Name:     "test",
+		Email:    "test@example.com",
+		HugoPath: fakeVersion(t, dir, "hugo", "Hugo Static Site Generator v0.74.3/extended linux/amd64"),
+	}
+	results := preflight(context.Background(), conf)
+	names := make([]string, len(results))
+	for i, res := range results {
+		names[i] = res.Name
+		if res.Err != nil {
+			t.Errorf("unexpected failed check %s", res)
+		}
+	}
+	if strings.Join(names, ",") != "config,pandoc,hugo,repo,remote,content dir" {
+		t.Errorf("unexpected checks %v", names)
+	}
+
+	//failures are reported per check
+	conf.HugoPath = fakeVersion(t, dir, "oldhugo", "Hugo Static Site Generator v0.40.1 linux/amd64")
+	PandocLoc = path.Join(dir, "missing")
+	failed := make(map[string]bool)
+	for _, res := range preflight(context.Background(), conf) {
+		if res.Err != nil {
+			failed[res.Name] = res.Required
+		}
+	}
+	if len(failed) != 2 || !failed["pandoc"] || !failed["hugo"] {
+		t.Errorf("expected pandoc and hugo to fail got %v", failed)
+	}
+	if err := logChecks(preflight(context.Background(), conf)); err == nil {
+		t.Error("expected failed required checks to stop startup")
+	}
+
+	//config errors skip the other checks
+	conf.Name = ""
+	if results = preflight(context.Background(), conf); len(results) != 1 || results[0].Err == nil {
+		t.Errorf("expected only a failed config check got %v", results)
+	}
+}
+
+func TestCheckRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blogposter-doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if _, res := checkRepo(&ServerConfig{Path: dir}); res.Err == nil || !res.Required {
+		t.Error("expected dir which isn't a repo to fail")
+	}
+
+	h := testRepo(t)
+	if err = os.Chmod(path.Join(h.path, "content", "post"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(path.Join(h.path, "content", "post"), 0755) })
+	if os.Geteuid() != 0 {
+		if res := checkContentDir(h); res.Err == nil {
+			t.Error("expected read only content dir to fail")
+		}
+	}
+	//missing content dirs are created by the first post
+	h.contentDir = "content/notes"
+	if err = os.Chmod(path.Join(h.path, "content", "post"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if res := checkContentDir(h); res.Err != nil {
+		t.Error(res)
+	}
+}
+
+func TestCheckRemoteRequired(t *testing.T) {
+	h := testRepo(t)
+	dir := path.Dir(h.path)
+	pandoc := PandocLoc
+	PandocLoc = fakeVersion(t, dir, "pandoc", "pandoc 2.9.2.1")
+	t.Cleanup(func() { PandocLoc = pandoc })
+	//point origin at a remote which doesn't exist
+	cfg, err := h.repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Remotes["origin"].URLs = []string{path.Join(dir, "missing")}
+	if err = h.repo.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	conf := &ServerConfig{
+		Path:     h.path,
+		Name:     "test",
+		Email:    "test@example.com",
+		HugoPath: fakeVersion(t, dir, "hugo", "Hugo Static Site Generator v0.74.3/extended linux/amd64"),
+	}
+	for _, test := range []bool{false, true} {
+		conf.Test = test
+		var remote *checkResult
+		for _, res := range preflight(context.Background(), conf) {
+			if res.Name == "remote" {
+				remote = res
+			}
+		}
+		if remote == nil || remote.Err == nil {
+			t.Fatalf("expected unreachable remote to fail got %v", remote)
+		}
+		//test mode doesn't push so only warns
+		if remote.Required == test {
+			t.Errorf("test mode %t: expected remote check required %t", test, !test)
+		}
+	}
+}
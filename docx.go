@@ -0,0 +1,456 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+//DocxConverter converts docx documents to markdown
+//without any external dependencies. It understands
+//headings, bold/italic/strikethrough text, links,
+//lists and embedded images
+type DocxConverter struct{}
+
+func (d *DocxConverter) Convert(c io.Reader, mime string) (*Conversion, error) {
+	if mime != docxMIME {
+		return nil, fmt.Errorf("docx: unsupported document type: %s", mime)
+	}
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, errors.New("docx: open archive: " + err.Error())
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	doc, ok := files["word/document.xml"]
+	if !ok {
+		return nil, errors.New("docx: archive is missing word/document.xml")
+	}
+
+	rels, err := readDocxRels(files["word/_rels/document.xml.rels"])
+	if err != nil {
+		return nil, errors.New("docx: read relationships: " + err.Error())
+	}
+	numbering, err := readDocxNumbering(files["word/numbering.xml"])
+	if err != nil {
+		return nil, errors.New("docx: read numbering: " + err.Error())
+	}
+
+	rc, err := doc.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	w := &docxWriter{rels: rels, numbering: numbering, embedded: make(map[string]bool)}
+	if err = w.walk(xml.NewDecoder(rc)); err != nil {
+		return nil, errors.New("docx: parse document: " + err.Error())
+	}
+
+	//collect referenced images from the archive
+	conv := &Conversion{Markdown: w.out.Bytes()}
+	for _, name := range w.media {
+		f, ok := files[path.Join("word", name)]
+		if !ok {
+			return nil, fmt.Errorf("docx: archive is missing media file %s", name)
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		conv.Assets = append(conv.Assets, &Asset{Name: name, Data: data})
+	}
+	return conv, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+type docxRel struct {
+	target   string
+	external bool
+}
+
+//readDocxRels maps relationship ids to their targets
+func readDocxRels(f *zip.File) (map[string]docxRel, error) {
+	rels := make(map[string]docxRel)
+	if f == nil {
+		return rels, nil
+	}
+	b, err := readZipFile(f)
+	if err != nil {
+		return nil, err
+	}
+	var v struct {
+		Rels []struct {
+			ID         string `xml:"Id,attr"`
+			Target     string `xml:"Target,attr"`
+			TargetMode string `xml:"TargetMode,attr"`
+		} `xml:"Relationship"`
+	}
+	if err = xml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	for _, r := range v.Rels {
+		rels[r.ID] = docxRel{target: r.Target, external: r.TargetMode == "External"}
+	}
+	return rels, nil
+}
+
+//readDocxNumbering maps numbering ids to whether
+//each list level is ordered
+func readDocxNumbering(f *zip.File) (map[string]map[string]bool, error) {
+	numbering := make(map[string]map[string]bool)
+	if f == nil {
+		return numbering, nil
+	}
+	b, err := readZipFile(f)
+	if err != nil {
+		return nil, err
+	}
+	type val struct {
+		Val string `xml:"val,attr"`
+	}
+	var v struct {
+		Abstract []struct {
+			ID     string `xml:"abstractNumId,attr"`
+			Levels []struct {
+				Level  string `xml:"ilvl,attr"`
+				NumFmt val    `xml:"numFmt"`
+			} `xml:"lvl"`
+		} `xml:"abstractNum"`
+		Nums []struct {
+			ID         string `xml:"numId,attr"`
+			AbstractID val    `xml:"abstractNumId"`
+		} `xml:"num"`
+	}
+	if err = xml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	abstract := make(map[string]map[string]bool)
+	for _, a := range v.Abstract {
+		levels := make(map[string]bool)
+		for _, l := range a.Levels {
+			levels[l.Level] = l.NumFmt.Val != "bullet" && l.NumFmt.Val != "none"
+		}
+		abstract[a.ID] = levels
+	}
+	for _, n := range v.Nums {
+		numbering[n.ID] = abstract[n.AbstractID.Val]
+	}
+	return numbering, nil
+}
+
+//docxSpan is a piece of paragraph content
+type docxSpan struct {
+	text   string
+	bold   bool
+	italic bool
+	strike bool
+	link   string
+	//image is the media path of an embedded image
+	image string
+	alt   string
+}
+
+type docxParagraph struct {
+	style string
+	numID string
+	level string
+	spans []docxSpan
+}
+
+//docxWriter walks a word/document.xml token
+//stream writing markdown to out
+type docxWriter struct {
+	rels      map[string]docxRel
+	numbering map[string]map[string]bool
+	out       bytes.Buffer
+	//media paths of embedded images in document order
+	media []string
+	//relationship ids of images already in media
+	embedded map[string]bool
+
+	para    *docxParagraph
+	run     docxSpan
+	inRun   bool
+	inRunPr bool
+	inText  bool
+	link    string
+	alt     string
+	//numbering id of the previous paragraph if it was a list item
+	lastNumID string
+}
+
+func (w *docxWriter) walk(d *xml.Decoder) error {
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			w.start(t)
+		case xml.EndElement:
+			w.end(t)
+		case xml.CharData:
+			if w.inText && w.para != nil {
+				w.addText(string(t))
+			}
+		}
+	}
+}
+
+func attr(e xml.StartElement, local string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+//toggled reports whether a run property element
+//such as <w:b/> switches its property on
+func toggled(e xml.StartElement) bool {
+	switch attr(e, "val") {
+	case "0", "false", "none":
+		return false
+	}
+	return true
+}
+
+func (w *docxWriter) start(e xml.StartElement) {
+	switch e.Name.Local {
+	case "p":
+		w.para = new(docxParagraph)
+	case "pStyle":
+		if w.para != nil {
+			w.para.style = attr(e, "val")
+		}
+	case "ilvl":
+		if w.para != nil {
+			w.para.level = attr(e, "val")
+		}
+	case "numId":
+		if w.para != nil {
+			w.para.numID = attr(e, "val")
+		}
+	case "hyperlink":
+		if rel, ok := w.rels[attr(e, "id")]; ok {
+			w.link = rel.target
+		} else if anchor := attr(e, "anchor"); len(anchor) > 0 {
+			w.link = "#" + anchor
+		}
+	case "r":
+		w.inRun = true
+		w.run = docxSpan{link: w.link}
+	case "rPr":
+		w.inRunPr = w.inRun
+	case "b":
+		if w.inRunPr {
+			w.run.bold = toggled(e)
+		}
+	case "i":
+		if w.inRunPr {
+			w.run.italic = toggled(e)
+		}
+	case "strike", "dstrike":
+		if w.inRunPr {
+			w.run.strike = toggled(e)
+		}
+	case "t":
+		w.inText = w.inRun
+	case "tab":
+		if w.inRun && !w.inRunPr {
+			w.addText("\t")
+		}
+	case "br", "cr":
+		if w.inRun && !w.inRunPr {
+			w.addText("\n")
+		}
+	case "docPr":
+		w.alt = attr(e, "descr")
+	case "blip":
+		rel, ok := w.rels[attr(e, "embed")]
+		if !ok || rel.external || w.para == nil {
+			return
+		}
+		//images referenced more than once are only one asset
+		if id := attr(e, "embed"); !w.embedded[id] {
+			w.embedded[id] = true
+			w.media = append(w.media, rel.target)
+		}
+		w.para.spans = append(w.para.spans, docxSpan{image: rel.target, alt: w.alt, link: w.link})
+		w.alt = ""
+	}
+}
+
+func (w *docxWriter) end(e xml.EndElement) {
+	switch e.Name.Local {
+	case "p":
+		if w.para != nil {
+			w.writeParagraph(w.para)
+		}
+		w.para = nil
+	case "hyperlink":
+		w.link = ""
+	case "r":
+		w.inRun = false
+	case "rPr":
+		w.inRunPr = false
+	case "t":
+		w.inText = false
+	}
+}
+
+func (w *docxWriter) addText(s string) {
+	span := w.run
+	span.text = s
+	w.para.spans = append(w.para.spans, span)
+}
+
+func (w *docxWriter) writeParagraph(p *docxParagraph) {
+	text := renderSpans(p.spans)
+	if len(strings.TrimSpace(text)) == 0 {
+		return
+	}
+	prefix := ""
+	numID := ""
+	if level := headingLevel(p.style); level > 0 {
+		prefix = strings.Repeat("#", level) + " "
+	} else if len(p.numID) > 0 && p.numID != "0" {
+		numID = p.numID
+		indent := 0
+		fmt.Sscan(p.level, &indent)
+		prefix = strings.Repeat("  ", indent) + "- "
+		if w.numbering[p.numID][p.level] {
+			prefix = strings.Repeat("   ", indent) + "1. "
+		}
+	}
+	//items of the same list are written without
+	//blank lines between them
+	if w.out.Len() > 0 && (len(numID) == 0 || numID != w.lastNumID) {
+		w.out.WriteByte('\n')
+	}
+	w.lastNumID = numID
+	w.out.WriteString(prefix)
+	w.out.WriteString(text)
+	w.out.WriteByte('\n')
+}
+
+//headingLevel returns the markdown heading level
+//for a paragraph style or 0 if it isn't a heading
+func headingLevel(style string) int {
+	s := strings.ToLower(style)
+	if s == "title" {
+		return 1
+	}
+	if !strings.HasPrefix(s, "heading") {
+		return 0
+	}
+	level := 0
+	fmt.Sscan(s[len("heading"):], &level)
+	if level > 6 {
+		level = 6
+	}
+	return level
+}
+
+//renderSpans renders paragraph content as markdown
+//merging adjacent spans with the same formatting
+func renderSpans(spans []docxSpan) string {
+	var merged []docxSpan
+	for _, s := range spans {
+		if n := len(merged); n > 0 && len(s.image) == 0 && len(merged[n-1].image) == 0 {
+			last := &merged[n-1]
+			if last.bold == s.bold && last.italic == s.italic && last.strike == s.strike && last.link == s.link {
+				last.text += s.text
+				continue
+			}
+		}
+		merged = append(merged, s)
+	}
+
+	sb := new(strings.Builder)
+	for i := 0; i < len(merged); i++ {
+		s := merged[i]
+		if len(s.link) == 0 {
+			sb.WriteString(renderSpan(s))
+			continue
+		}
+		//render all consecutive spans sharing a link
+		//inside a single link
+		inner := new(strings.Builder)
+		for ; i < len(merged) && merged[i].link == s.link; i++ {
+			inner.WriteString(renderSpan(merged[i]))
+		}
+		i--
+		fmt.Fprintf(sb, "[%s](%s)", inner.String(), s.link)
+	}
+	return sb.String()
+}
+
+//markdownEscaper escapes characters in document text
+//which markdown would read as formatting or raw html
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"`", "\\`",
+	"*", `\*`,
+	"_", `\_`,
+	"#", `\#`,
+	"[", `\[`,
+	"]", `\]`,
+	"<", `\<`,
+	"~", `\~`,
+)
+
+func renderSpan(s docxSpan) string {
+	if len(s.image) > 0 {
+		return fmt.Sprintf("![%s](%s)", markdownEscaper.Replace(s.alt), s.image)
+	}
+	s.text = markdownEscaper.Replace(s.text)
+	marker := ""
+	if s.bold {
+		marker += "**"
+	}
+	if s.italic {
+		marker += "*"
+	}
+	if s.strike {
+		marker += "~~"
+	}
+	body := strings.TrimSpace(s.text)
+	if len(marker) == 0 || len(body) == 0 {
+		return s.text
+	}
+	//markers can't be adjacent to whitespace so
+	//keep surrounding whitespace outside of them
+	lead := s.text[:strings.Index(s.text, body)]
+	trail := s.text[len(lead)+len(body):]
+	closing := []rune(marker)
+	for i, j := 0, len(closing)-1; i < j; i, j = i+1, j-1 {
+		closing[i], closing[j] = closing[j], closing[i]
+	}
+	return lead + marker + body + string(closing) + trail
+}
@@ -59,9 +59,9 @@ func TestDownload(t *testing.T) {
 		t.Errorf("error downloading file: %s", err)
 	}
 	defer body.Close()
-	content, err := getDocContent(body)
+	content, err := new(PandocConverter).Convert(body, docxMIME)
 	if err != nil {
 		t.Errorf("error converting document content: %s", err)
 	}
-	fmt.Printf("%s", content)
+	fmt.Printf("%s", content.Markdown)
 }
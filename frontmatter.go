@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+//front matter formats
+const (
+	fmJSON = "json"
+	fmYAML = "yaml"
+	fmTOML = "toml"
+)
+
+var fmDelims = map[string]string{
+	fmYAML: "---",
+	fmTOML: "+++",
+}
+
+type frontMatter struct {
+	Title   string    `json:"title"`
+	Author  string    `json:"author,omitempty"`
+	Date    time.Time `json:"date"`
+	Summary string    `json:"summary,omitempty"`
+	Tags    []string  `json:"tags,omitemtpy"`
+	Img     string    `json:"Img,omitempty"`
+	Draft   bool      `json:"draft,omitempty"`
+	//PublishDate is set for posts scheduled in the future
+	PublishDate time.Time `json:"publishDate,omitempty"`
+	//format the front matter is written in
+	format string
+	//keys the cms doesn't model
+	extra map[string]interface{}
+}
+
+//TagList returns a space seperated list of tags
+func (fm *frontMatter) TagList() string {
+	s := ""
+	if len(fm.Tags) == 0 {
+		return s
+	}
+	for _, t := range fm.Tags {
+		s = s + " " + t
+	}
+	return s[1:]
+}
+
+//fmField is a front matter key and value
+type fmField struct {
+	key   string
+	value interface{}
+}
+
+//fields returns the front matter fields with the
+//modelled keys first followed by any extra keys
+func (fm *frontMatter) fields() []fmField {
+	f := []fmField{{"title", fm.Title}}
+	if len(fm.Author) > 0 {
+		f = append(f, fmField{"author", fm.Author})
+	}
+	f = append(f, fmField{"date", fm.Date})
+	if len(fm.Summary) > 0 {
+		f = append(f, fmField{"summary", fm.Summary})
+	}
+	f = append(f, fmField{"tags", fm.Tags})
+	if len(fm.Img) > 0 {
+		f = append(f, fmField{"Img", fm.Img})
+	}
+	if fm.Draft {
+		f = append(f, fmField{"draft", fm.Draft})
+	}
+	if !fm.PublishDate.IsZero() {
+		f = append(f, fmField{"publishDate", fm.PublishDate})
+	}
+	keys := make([]string, 0, len(fm.extra))
+	for k := range fm.extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f = append(f, fmField{k, fm.extra[k]})
+	}
+	return f
+}
+
+//Bytes returns the front matter encoded in its
+//format including delimiters
+func (fm *frontMatter) Bytes() ([]byte, error) {
+	fields := fm.fields()
+	buf := new(bytes.Buffer)
+	switch fm.format {
+	case fmYAML:
+		ms := make(yaml.MapSlice, len(fields))
+		for i, f := range fields {
+			ms[i] = yaml.MapItem{Key: f.key, Value: f.value}
+		}
+		b, err := yaml.Marshal(ms)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString("---\n")
+		buf.Write(b)
+		buf.WriteString("---\n")
+	case fmTOML:
+		m := make(map[string]interface{}, len(fields))
+		for _, f := range fields {
+			m[f.key] = f.value
+		}
+		buf.WriteString("+++\n")
+		if err := toml.NewEncoder(buf).Encode(m); err != nil {
+			return nil, err
+		}
+		buf.WriteString("+++\n")
+	case fmJSON, "":
+		//write keys in field order rather than
+		//the sorted order of a marshalled map
+		buf.WriteString("{")
+		for i, f := range fields {
+			v, err := json.MarshalIndent(f.value, "    ", "    ")
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", f.key, err)
+			}
+			k, _ := json.Marshal(f.key)
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(buf, "\n    %s: %s", k, v)
+		}
+		buf.WriteString("\n}\n")
+	default:
+		return nil, fmt.Errorf("unknown front matter format: %s", fm.format)
+	}
+	return buf.Bytes(), nil
+}
+
+//parseFrontMatter splits a post file into its front
+//matter and content detecting the front matter format
+//from its opening delimiter
+func parseFrontMatter(b []byte) (*frontMatter, []byte, error) {
+	m := make(map[string]interface{})
+	var content []byte
+	var format string
+	switch {
+	case bytes.HasPrefix(b, []byte("{")):
+		format = fmJSON
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		if err := dec.Decode(&m); err != nil {
+			return nil, nil, errors.New("json front matter: " + err.Error())
+		}
+		content = b[dec.InputOffset():]
+	case bytes.HasPrefix(b, []byte("---")):
+		format = fmYAML
+		raw, rest, err := splitDelimited(b, fmDelims[fmYAML])
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = yaml.Unmarshal(raw, &m); err != nil {
+			return nil, nil, errors.New("yaml front matter: " + err.Error())
+		}
+		content = rest
+	case bytes.HasPrefix(b, []byte("+++")):
+		format = fmTOML
+		raw, rest, err := splitDelimited(b, fmDelims[fmTOML])
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = toml.Unmarshal(raw, &m); err != nil {
+			return nil, nil, errors.New("toml front matter: " + err.Error())
+		}
+		content = rest
+	default:
+		return nil, nil, errors.New("post does not start with json, yaml or toml front matter")
+	}
+	//drop the newline ending the front matter
+	if bytes.HasPrefix(content, []byte("\r\n")) {
+		content = content[2:]
+	} else if bytes.HasPrefix(content, []byte("\n")) {
+		content = content[1:]
+	}
+	fm, err := frontMatterFromMap(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	fm.format = format
+	return fm, content, nil
+}
+
+//splitDelimited splits b into the front matter between
+//the opening and closing delim lines and the rest of
+//the file after the closing line
+func splitDelimited(b []byte, delim string) ([]byte, []byte, error) {
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	offset := len(lines[0])
+	for _, line := range lines[1:] {
+		if string(bytes.TrimSpace(line)) == delim {
+			return b[len(lines[0]):offset], b[offset+len(line):], nil
+		}
+		offset += len(line)
+	}
+	return nil, nil, fmt.Errorf("front matter is missing closing %s", delim)
+}
+
+//frontMatterFromMap sets the modelled front matter
+//fields from m keeping all other keys as extras
+func frontMatterFromMap(m map[string]interface{}) (*frontMatter, error) {
+	fm := &frontMatter{extra: make(map[string]interface{})}
+	for k, v := range m {
+		var err error
+		//hugo front matter keys are case insensitive
+		switch strings.ToLower(k) {
+		case "title":
+			fm.Title = fmt.Sprint(v)
+		case "author":
+			fm.Author = fmt.Sprint(v)
+		case "summary":
+			fm.Summary = fmt.Sprint(v)
+		case "img":
+			fm.Img = fmt.Sprint(v)
+		case "date":
+			fm.Date, err = fmTime(v)
+		case "tags":
+			fm.Tags, err = fmStrings(v)
+		case "draft":
+			fm.Draft, err = fmBool(v)
+		case "publishdate":
+			fm.PublishDate, err = fmTime(v)
+		default:
+			fm.extra[k] = v
+		}
+		if err != nil {
+			return nil, fmt.Errorf("front matter %s: %s", k, err)
+		}
+	}
+	return fm, nil
+}
+
+func fmTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+			if d, err := time.Parse(layout, t); err == nil {
+				return d, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("unrecognized date format: %s", t)
+	}
+	return time.Time{}, fmt.Errorf("unexpected date type %T", v)
+}
+
+func fmStrings(v interface{}) ([]string, error) {
+	switch t := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{t}, nil
+	case []string:
+		return t, nil
+	case []interface{}:
+		s := make([]string, len(t))
+		for i, item := range t {
+			s[i] = fmt.Sprint(item)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unexpected list type %T", v)
+}
+
+func fmBool(v interface{}) (bool, error) {
+	switch t := v.(type) {
+	case bool:
+		return t, nil
+	case string:
+		return strconv.ParseBool(t)
+	}
+	return false, fmt.Errorf("unexpected boolean type %T", v)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const testContent = "Some content with {braces} and a code block:\n\n```go\nfunc main() {}\n```\n"
+
+var testPosts = map[string]string{
+	fmJSON: `{
+    "title": "A Post",
+    "author": "Me",
+    "date": "2021-02-03T04:05:06Z",
+    "tags": [
+        "one",
+        "two"
+    ],
+    "draft": true,
+    "weight": 10
+}
+` + testContent,
+	fmYAML: `---
+title: A Post
+author: Me
+date: 2021-02-03T04:05:06Z
+tags:
+- one
+- two
+draft: true
+weight: 10
+---
+` + testContent,
+	fmTOML: `+++
+title = "A Post"
+author = "Me"
+date = 2021-02-03T04:05:06Z
+tags = ["one", "two"]
+draft = true
+weight = 10
++++
+` + testContent,
+}
+
+func TestParseFrontMatter(t *testing.T) {
+	date := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	for format, src := range testPosts {
+		p, err := existingPost([]byte(src))
+		if err != nil {
+			t.Fatalf("%s: error parsing post: %s", format, err)
+		}
+		fm := p.frontMatter
+		if fm.format != format {
+			t.Errorf("%s: detected format %s", format, fm.format)
+		}
+		if fm.Title != "A Post" || fm.Author != "Me" || !fm.Date.Equal(date) || fm.TagList() != "one two" {
+			t.Errorf("%s: unexpected front matter %+v", format, fm)
+		}
+		if !fm.Draft || len(fm.extra) != 1 || fm.extra["weight"] == nil {
+			t.Errorf("%s: unknown keys not preserved: %v", format, fm.extra)
+		}
+		if string(p.content) != testContent {
+			t.Errorf("%s: unexpected content %q", format, p.content)
+		}
+	}
+}
+
+func TestFrontMatterRoundTrip(t *testing.T) {
+	for format, src := range testPosts {
+		p, err := existingPost([]byte(src))
+		if err != nil {
+			t.Fatalf("%s: error parsing post: %s", format, err)
+		}
+		b, err := p.Bytes()
+		if err != nil {
+			t.Fatalf("%s: error writing post: %s", format, err)
+		}
+		p2, err := existingPost(b)
+		if err != nil {
+			t.Fatalf("%s: error re-parsing post: %s\n%s", format, err, b)
+		}
+		if p2.frontMatter.format != format {
+			t.Errorf("%s: format changed to %s", format, p2.frontMatter.format)
+		}
+		b2, err := p2.Bytes()
+		if err != nil {
+			t.Fatalf("%s: error writing post: %s", format, err)
+		}
+		if string(b) != string(b2) {
+			t.Errorf("%s: post changed after round trip:\n%s\n%s", format, b, b2)
+		}
+		if !p2.frontMatter.Draft || len(p2.frontMatter.extra) != 1 {
+			t.Errorf("%s: unknown keys lost: %v", format, p2.frontMatter.extra)
+		}
+	}
+	//json output is unchanged by a round trip
+	b, _ := testPost(t, fmJSON).Bytes()
+	if string(b) != testPosts[fmJSON] {
+		t.Errorf("json post changed:\n%s", b)
+	}
+}
+
+func TestParseFrontMatterErrors(t *testing.T) {
+	for _, src := range []string{
+		"no front matter",
+		"---\ntitle: unterminated\n",
+		"{\"title\": ",
+	} {
+		if _, err := existingPost([]byte(src)); err == nil {
+			t.Errorf("expected error parsing %q", src)
+		}
+	}
+}
+
+func testPost(t *testing.T, format string) *post {
+	p, err := existingPost([]byte(testPosts[format]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
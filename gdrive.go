@@ -23,10 +23,10 @@ const docxMIME = "application/vnd.openxmlformats-officedocument.wordprocessingml
 const folderMIME = "application/vnd.google-apps.folder"
 
 type GAPIConfig struct {
-	PrivateKeyID string
-	PrivateKey   string
-	Email        string
-	TokenURL     string
+	PrivateKeyID string `json:"privatekeyid"`
+	PrivateKey   string `json:"privatekey"`
+	Email        string `json:"email"`
+	TokenURL     string `json:"tokenurl"`
 }
 
 type gmarshaler interface {
@@ -110,3 +110,34 @@ func (g *GDriveClient) GetFile(id string) (io.ReadCloser, error) {
 	return fileresp.Body, nil
 
 }
+
+//ListImages lists the image files in drive
+func (g *GDriveClient) ListImages() ([]*drive.File, error) {
+	files, err := g.Service.Files.List().Q("mimeType contains 'image/' and trashed = false").Do()
+	if err != nil {
+		return nil, err
+	}
+	return files.Files, nil
+}
+
+//GetImage downloads the image file id returning
+//its file name and contents
+func (g *GDriveClient) GetImage(id string) (string, []byte, error) {
+	file, err := g.Service.Files.Get(id).Fields("name").Do()
+	if err != nil {
+		return "", nil, err
+	}
+	resp, err := g.Service.Files.Get(id).Download()
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode != 200 {
+		return "", nil, errors.New(fmt.Sprintf("download request returned non-successful error code: %d - %s", resp.StatusCode, b))
+	}
+	return file.Name, b, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+//git auth methods
+const (
+	//gitAuthBasic is http basic auth with a password or token
+	gitAuthBasic = "basic"
+	//gitAuthTokenFile is http basic auth with a token read from a file
+	gitAuthTokenFile = "tokenfile"
+	//gitAuthSSH is ssh public key auth
+	gitAuthSSH = "ssh"
+)
+
+//GitAuth is how clones, pulls and pushes of the blog
+//repo and the site branch authenticate with the remote
+type GitAuth struct {
+	//Method is basic, tokenfile or ssh. Empty uses ssh auth
+	//for ssh remote urls with an sshkey, basic auth for other
+	//remote urls if the config has a token and no auth otherwise.
+	//Without a remote url the cloned repo's origin is used
+	Method string `json:"method"`
+	//Username for basic and tokenfile auth. Defaults to the
+	//config's username. The ssh user defaults to git
+	Username string `json:"username"`
+	//Password or token for basic auth. Defaults to the config's token
+	Password string `json:"password"`
+	//TokenFile the tokenfile token is read from e.g. a docker secret
+	TokenFile string `json:"tokenfile"`
+	//SSHKey is the path of the ssh private key
+	SSHKey string `json:"sshkey"`
+	//SSHKeyPassphrase decrypts an encrypted SSHKey
+	SSHKeyPassphrase string `json:"sshkeypassphrase"`
+	//KnownHosts files verifying the remote's host key. Defaults
+	//to $SSH_KNOWN_HOSTS or ~/.ssh/known_hosts and /etc/ssh/ssh_known_hosts
+	KnownHosts []string `json:"knownhosts"`
+}
+
+//gitAuth returns the git auth of the config or an empty
+//one which uses basic auth if the config has a token
+func (c *ServerConfig) gitAuth() *GitAuth {
+	if c.GitAuth != nil {
+		return c.GitAuth
+	}
+	return new(GitAuth)
+}
+
+//remoteURL returns the configured remote url or the url of
+//the origin of the repo at path if it's already cloned
+func (c *ServerConfig) remoteURL() string {
+	if len(c.RemoteUrl) > 0 || len(c.Path) == 0 {
+		return c.RemoteUrl
+	}
+	repo, err := git.PlainOpen(c.Path)
+	if err != nil {
+		return ""
+	}
+	origin, err := repo.Remote("origin")
+	if err != nil || len(origin.Config().URLs) == 0 {
+		return ""
+	}
+	return origin.Config().URLs[0]
+}
+
+//isSSH reports whether remoteURL is an ssh:// or scp
+//style url such as git@github.com:user/repo.git
+func isSSH(remoteURL string) bool {
+	ep, err := transport.NewEndpoint(remoteURL)
+	return err == nil && ep.Protocol == "ssh"
+}
+
+//method returns the auth method used with remoteURL.
+//password is the basic auth password or token
+func (a *GitAuth) method(remoteURL, password string) string {
+	switch {
+	case len(a.Method) > 0:
+		return a.Method
+	case len(remoteURL) > 0 && isSSH(remoteURL):
+		//without a key go-git uses the ssh agent
+		if len(a.SSHKey) > 0 {
+			return gitAuthSSH
+		}
+	case len(password) > 0:
+		return gitAuthBasic
+	}
+	return ""
+}
+
+//Validate checks the auth is complete and works with
+//the protocol of the remote url if it is set
+func (a *GitAuth) Validate(remoteURL string) error {
+	switch a.Method {
+	case "", gitAuthBasic:
+	case gitAuthTokenFile:
+		if len(a.TokenFile) == 0 {
+			return errors.New("tokenfile auth has no tokenfile")
+		}
+	case gitAuthSSH:
+		if len(a.SSHKey) == 0 {
+			return errors.New("ssh auth has no sshkey")
+		}
+	default:
+		return fmt.Errorf("unknown git auth method: %s", a.Method)
+	}
+	//the password doesn't matter as basic auth with
+	//an ssh remote is only inferred if method is set
+	method := a.method(remoteURL, "")
+	if len(remoteURL) == 0 || len(method) == 0 {
+		return nil
+	}
+	ep, err := transport.NewEndpoint(remoteURL)
+	if err != nil {
+		return err
+	}
+	if ssh := ep.Protocol == "ssh"; ssh != (method == gitAuthSSH) {
+		return fmt.Errorf("%s auth can't be used with the %s remote url %s", method, ep.Protocol, remoteURL)
+	}
+	return nil
+}
+
+//AuthMethod returns the go-git auth of conf or nil
+//if the remote doesn't need auth
+func (c *ServerConfig) AuthMethod() (transport.AuthMethod, error) {
+	a := c.gitAuth()
+	username := a.Username
+	if len(username) == 0 {
+		username = c.Username
+	}
+	password := a.Password
+	if len(password) == 0 {
+		password = c.Token
+	}
+	switch a.method(c.remoteURL(), password) {
+	case gitAuthBasic:
+		return &githttp.BasicAuth{Username: username, Password: password}, nil
+	case gitAuthTokenFile:
+		b, err := ioutil.ReadFile(a.TokenFile)
+		if err != nil {
+			return nil, errors.New("read token file: " + err.Error())
+		}
+		token := strings.TrimSpace(string(b))
+		if len(token) == 0 {
+			return nil, fmt.Errorf("token file %s is empty", a.TokenFile)
+		}
+		//hosts like github ignore the username of token auth but it can't be empty
+		if len(username) == 0 {
+			username = "git"
+		}
+		return &githttp.BasicAuth{Username: username, Password: token}, nil
+	case gitAuthSSH:
+		if len(a.Username) == 0 {
+			username = "git"
+		}
+		keys, err := gitssh.NewPublicKeysFromFile(username, a.SSHKey, a.SSHKeyPassphrase)
+		if err != nil {
+			return nil, errors.New("ssh key: " + err.Error())
+		}
+		keys.HostKeyCallback, err = gitssh.NewKnownHostsCallback(a.KnownHosts...)
+		if err != nil {
+			return nil, errors.New("known hosts: " + err.Error())
+		}
+		return keys, nil
+	}
+	return nil, nil
+}
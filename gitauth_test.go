@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestBasicAuth(t *testing.T) {
+	auth, err := (&ServerConfig{}).AuthMethod()
+	if err != nil || auth != nil {
+		t.Errorf("expected no auth without a token got %v %v", auth, err)
+	}
+	auth, err = (&ServerConfig{Username: "writer", Token: "token"}).AuthMethod()
+	if basic, ok := auth.(*githttp.BasicAuth); err != nil || !ok || basic.Username != "writer" || basic.Password != "token" {
+		t.Errorf("expected basic auth with the username and token got %v %v", auth, err)
+	}
+	//a token isn't sent to ssh remotes
+	auth, err = (&ServerConfig{Token: "token", RemoteUrl: "git@github.com:user/blog.git"}).AuthMethod()
+	if err != nil || auth != nil {
+		t.Errorf("expected no auth for an ssh remote without a key got %v %v", auth, err)
+	}
+
+	dir, err := ioutil.TempDir("", "blogposter-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	tokenFile := path.Join(dir, "token")
+	if err = ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err = (&ServerConfig{Token: "ignored", GitAuth: &GitAuth{Method: gitAuthTokenFile, TokenFile: tokenFile}}).AuthMethod()
+	if basic, ok := auth.(*githttp.BasicAuth); err != nil || !ok || basic.Username != "git" || basic.Password != "file-token" {
+		t.Errorf("expected basic auth with the file's token got %v %v", auth, err)
+	}
+	if _, err = (&ServerConfig{GitAuth: &GitAuth{Method: gitAuthTokenFile, TokenFile: path.Join(dir, "missing")}}).AuthMethod(); err == nil {
+		t.Error("expected missing token file to fail")
+	}
+}
+
+func TestSSHAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blogposter-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("passphrase"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(dir, "id_rsa")
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	knownHosts := path.Join(dir, "known_hosts")
+	if err = ioutil.WriteFile(knownHosts, []byte("git.example.com "+string(ssh.MarshalAuthorizedKey(hostKey))), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &ServerConfig{
+		Username:  "ignored",
+		RemoteUrl: "git@git.example.com:user/blog.git",
+		GitAuth:   &GitAuth{Method: gitAuthSSH, SSHKey: keyFile, SSHKeyPassphrase: "passphrase", KnownHosts: []string{knownHosts}},
+	}
+	if err = conf.GitAuth.Validate(conf.RemoteUrl); err != nil {
+		t.Error(err)
+	}
+	auth, err := conf.AuthMethod()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, ok := auth.(*gitssh.PublicKeys)
+	if !ok || keys.User != "git" {
+		t.Fatalf("expected ssh auth as git got %v", auth)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+	if err = keys.HostKeyCallback("git.example.com:22", addr, hostKey); err != nil {
+		t.Error("known host rejected: ", err)
+	}
+	if err = keys.HostKeyCallback("other.example.com:22", addr, hostKey); err == nil {
+		t.Error("unknown host accepted")
+	}
+
+	//ssh auth is inferred from the remote url
+	conf.GitAuth.Method = ""
+	conf.Token = "token"
+	if auth, err = conf.AuthMethod(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = auth.(*gitssh.PublicKeys); !ok {
+		t.Errorf("expected ssh auth for an ssh remote got %v", auth)
+	}
+
+	//or from the origin of an existing repo
+	repoDir := path.Join(dir, "blog")
+	repo, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{conf.RemoteUrl}}); err != nil {
+		t.Fatal(err)
+	}
+	conf.RemoteUrl = ""
+	conf.Path = repoDir
+	if err = conf.GitAuth.Validate(conf.remoteURL()); err != nil {
+		t.Error(err)
+	}
+	if auth, err = conf.AuthMethod(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = auth.(*gitssh.PublicKeys); !ok {
+		t.Errorf("expected ssh auth for an ssh origin got %v", auth)
+	}
+
+	conf.GitAuth.SSHKeyPassphrase = "wrong"
+	if _, err = conf.AuthMethod(); err == nil {
+		t.Error("expected wrong passphrase to fail")
+	}
+}
+
+func TestGitAuthValidate(t *testing.T) {
+	for _, c := range []struct {
+		auth   *GitAuth
+		remote string
+	}{
+		{&GitAuth{Method: "kerberos"}, ""},
+		{&GitAuth{Method: gitAuthTokenFile}, ""},
+		{&GitAuth{Method: gitAuthSSH}, ""},
+		{&GitAuth{Method: gitAuthSSH, SSHKey: "id_rsa"}, "https://github.com/user/blog.git"},
+		{&GitAuth{Method: gitAuthBasic}, "ssh://git@github.com/user/blog.git"},
+		{&GitAuth{Method: gitAuthTokenFile, TokenFile: "token"}, "git@github.com:user/blog.git"},
+	} {
+		if err := c.auth.Validate(c.remote); err == nil {
+			t.Errorf("expected error validating %+v with %s", c.auth, c.remote)
+		}
+	}
+}
@@ -3,8 +3,11 @@ module github.com/justinsantoro/blogposter
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/PuerkitoBio/goquery v1.6.0
 	github.com/go-git/go-git/v5 v5.2.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/oauth2 v0.0.0-20201208152858-08078c50e5b5
 	google.golang.org/api v0.30.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -3,183 +3,409 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/go-git/go-git/v5/plumbing/object"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net/http"
+	"os"
 	"os/exec"
 	"path"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-git/go-git/v5"
-	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 )
 
-var PandocLoc = "pandoc"
 var r = regexp.MustCompile("[^a-zA-Z0-9\\s]+")
-var lbrk = regexp.MustCompile("\\\\\n")
-var listblkqtreplace = "  -"
-var listblkqt = regexp.MustCompile(`\s\s-\s>`)
-var numlistblkqtreplace = "1."
-var numlistblkqt = regexp.MustCompile(`\d{1,3}\.\s{1,2}>`)
-var listblkqtconinuedreplace = ""
-var listblkqtcontinued = regexp.MustCompile(`\s\s\s\s>\s`)
-
-//GetDocContent takes path to file assumed to be
-//a docx file to be converted to commonmark via
-//pandoc
-func getDocContent(c io.Reader) ([]byte, error) {
-	outbuf := new(bytes.Buffer)
-	cmd := exec.Command(PandocLoc, "-f", "docx", "-t", "commonmark", "-o", "-")
-	log.Println(cmd.String())
-	cmd.Stdin = c
-	cmd.Stdout = outbuf
-	err := cmd.Run()
-	if err != nil {
-		switch e := err.(type) {
-		case *exec.ExitError:
-			//pandoc outputs error messages to stdout - not stderr
-			err = fmt.Errorf("%s: %s", e.Error(), outbuf.String())
-		}
-		return nil, err
-	}
-	b := outbuf.Bytes()
-	//replace gt and lt html placeholders with literals
-	b = bytes.ReplaceAll(b, []byte("&gt;"), []byte{'>'})
-	b = bytes.ReplaceAll(b, []byte("&lt;"), []byte{'<'})
-	//undo pandoc escaping of horizontal line rules
-	b = bytes.ReplaceAll(b, []byte("\\---"), []byte("---"))
-	//undo pandoc escaping of markdown line breaks
-	b = lbrk.ReplaceAll(b, []byte(""))
-	//undo pandoc making bulleted list items blockquotes
-	b = listblkqt.ReplaceAll(b, []byte(listblkqtreplace))
-	//undo pandoc making number list items blockquotes
-	b = numlistblkqt.ReplaceAll(b, []byte(numlistblkqtreplace))
-	//replace all list block quote line continuations
-	b = listblkqtcontinued.ReplaceAll(b, []byte(listblkqtconinuedreplace))
-	//undo pandoc escaping of backticks
-	b = bytes.ReplaceAll(b, []byte("\\`"), []byte("`"))
 
-	return b, nil
-}
+//defaultContentDir is the site dir posts are written to
+const defaultContentDir = "content/post"
 
-type frontMatter struct {
-	Title       string    `json:"title"`
-	Author      string    `json:"author,omitempty"`
-	Date        time.Time `json:"date"`
-	Summary string    `json:"summary,omitempty"`
-	Tags        []string  `json:"tags,omitemtpy"`
-	Img string `json:"Img,omitempty"`
-}
+var errNoChange = errors.New("no pending change")
 
-func (fm *frontMatter) Json() ([]byte, error) {
-	return json.MarshalIndent(fm, "", "    ")
-}
+//errInvalidPostName is returned for post names which
+//aren't a plain slug and could point outside the content dir
+var errInvalidPostName = errors.New("invalid post name")
 
-//TagList returns a space seperated list of tags
-func (fm *frontMatter) TagList() string {
-	s := ""
-	if len(fm.Tags) == 0 {
-		return s
-	}
-	for _, t := range fm.Tags{
-		s = s + " " + t
+//postNameRegexp matches the names Slug makes as well as
+//the capitals and underscores of hand written post files.
+//Names can't contain a path separator or dots
+var postNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+//validPostName returns an error wrapping errInvalidPostName
+//if name can't be used as a post's file and asset dir name
+func validPostName(name string) error {
+	if !postNameRegexp.MatchString(name) {
+		return fmt.Errorf("%w %q", errInvalidPostName, name)
 	}
-	return s[1:]
+	return nil
 }
 
+//errPendingChange is returned when staging a change to a
+//post which has a pending change by another author
+var errPendingChange = errors.New("has a pending change")
+
+//errConflict is returned when publishing a change whose
+//files were changed on the remote after it was staged
+var errConflict = errors.New("conflicts with remote changes")
+
+//errSitePush is returned when a change was published but
+//pushing the built site branch failed. The site is only
+//out of date until the next publish pushes it
+var errSitePush = errors.New("push site branch")
+
+//maxDeployAttempts limits how often a change is rebased
+//when its push is rejected as the remote moved on
+const maxDeployAttempts = 3
+
 //Post is a blog post
 type post struct {
 	content     []byte
 	frontMatter *frontMatter
+	//files stored in the post's asset dir
+	assets []*Asset
+	//asset files of an earlier version of the
+	//post removed when the post is published
+	stale []string
+	//repo file the post was read from
+	fname string
+	//name of an existing post used for its file and asset
+	//dir so changing its title doesn't move it
+	name string
+}
+
+//postDetails are the user provided details of a post
+type postDetails struct {
+	Title   string
+	Tags    string
+	Summary string
+	Author  string
+	//Draft saves the post as a hugo draft
+	Draft bool
+	//Date to publish the post at. Zero publishes now
+	Date time.Time
+	//Cover image of the post. nil keeps the current cover
+	Cover *Cover
+	//GitAuthor of the commit publishing the post.
+	//nil commits as the repo's identity
+	GitAuthor *Identity
+}
+
+//Identity is a git commit author or committer
+type Identity struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+//Cover is the cover image chosen for a post
+type Cover struct {
+	//FirstImage uses the first image in the document
+	FirstImage bool
+	//Name and Data of an image file to use
+	Name string
+	Data []byte
 }
 
-//newPost returns a post
-func newPost(c io.Reader, title, tags string, summary string, author string) (*post, error) {
-	doc, err := getDocContent(c)
+//newPost returns a post converting the document c of type
+//mime with conv. name is the name of the existing post the
+//document updates. Empty names the post after its title
+func newPost(conv Converter, c io.Reader, mime, name string, d *postDetails) (*post, error) {
+	doc, err := conv.Convert(c, mime)
 	if err != nil {
 		return nil, err
 	}
-	return &post{
-		content: doc,
+	p := &post{
+		name:    name,
+		content: doc.Markdown,
 		frontMatter: &frontMatter{
-			Title:       title,
-			Author:      author,
-			Date:        time.Now(),
-			Summary: summary,
-			Tags:        strings.Split(tags, " "),
+			Title:   d.Title,
+			Author:  d.Author,
+			Date:    time.Now(),
+			Summary: d.Summary,
+			Tags:    strings.Fields(d.Tags),
+			Draft:   d.Draft,
 		},
-	}, nil
+	}
+	if !d.Date.IsZero() {
+		p.frontMatter.Date = d.Date
+		p.frontMatter.PublishDate = d.Date
+	}
+	p.addAssets(doc.Assets)
+	if err = p.setCover(d.Cover); err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
-func existingPost(b []byte) (*post, error) {
-	p := &post{frontMatter:new(frontMatter)}
-	//split off front matter
-	parts := bytes.SplitAfter(b, []byte{'}'})
-	if len(parts) > 2 {
-		return nil, errors.New("can't parse post because it contains more than one '}' character")
+//setCover sets the post's Img to the chosen cover
+func (p *post) setCover(cover *Cover) error {
+	switch {
+	case cover == nil:
+		return nil
+	case cover.FirstImage:
+		if len(p.assets) > 0 {
+			p.frontMatter.Img = p.AssetURL(p.assets[0].Name)
+		}
+	case len(cover.Data) > 0:
+		ext, err := cover.ext()
+		if err != nil {
+			return err
+		}
+		name := p.assetName("cover" + ext)
+		p.assets = append(p.assets, &Asset{Name: name, Data: cover.Data})
+		p.frontMatter.Img = p.AssetURL(name)
+	}
+	return nil
+}
+
+//ext returns the file extension of the cover image taken
+//from its name or else its detected type. Covers which
+//aren't images are rejected
+func (c *Cover) ext() (string, error) {
+	ext := strings.ToLower(path.Ext(c.Name))
+	typ := http.DetectContentType(c.Data)
+	if !strings.HasPrefix(typ, "image/") {
+		//images the sniffer doesn't know such as svg
+		//are only recognized by their extension
+		if !strings.HasPrefix(mime.TypeByExtension(ext), "image/") {
+			return "", fmt.Errorf("cover %s is not an image: %s", c.Name, typ)
+		}
+		return ext, nil
 	}
-	err := json.Unmarshal(parts[0], p.frontMatter)
+	if len(ext) > 0 {
+		return ext, nil
+	}
+	exts, err := mime.ExtensionsByType(typ)
+	if err != nil || len(exts) == 0 {
+		return "", fmt.Errorf("cover %s: no file extension for %s", c.Name, typ)
+	}
+	//prefer the common .jpg over .jfif or .jpe
+	ext = exts[0]
+	for _, e := range exts {
+		if e == ".jpg" {
+			ext = e
+		}
+	}
+	return ext, nil
+}
+
+//addAssets adds files extracted from the post's
+//document rewriting references to them in the content
+//to point at their location in the post's asset dir
+func (p *post) addAssets(assets []*Asset) {
+	for _, a := range assets {
+		name := p.assetName(path.Base(a.Name))
+		url := []byte(p.AssetURL(name))
+		//markdown image links and raw html attributes
+		p.content = bytes.ReplaceAll(p.content, []byte("("+a.Name), append([]byte{'('}, url...))
+		p.content = bytes.ReplaceAll(p.content, []byte(`"`+a.Name+`"`), []byte(`"`+string(url)+`"`))
+		p.assets = append(p.assets, &Asset{Name: name, Data: a.Data})
+	}
+}
+
+//assetName returns name or name prefixed with an
+//index if the post already has an asset called name
+func (p *post) assetName(name string) string {
+	unique := name
+	for i := 1; ; i++ {
+		taken := false
+		for _, a := range p.assets {
+			taken = taken || a.Name == unique
+		}
+		if !taken {
+			return unique
+		}
+		unique = fmt.Sprintf("%d-%s", i, name)
+	}
+}
+
+//existingPost parses a post file with json, yaml
+//or toml front matter
+func existingPost(b []byte) (*post, error) {
+	fm, content, err := parseFrontMatter(b)
 	if err != nil {
 		return nil, err
 	}
-	p.content = parts[1]
-	return p, nil
+	return &post{frontMatter: fm, content: content}, nil
 }
 
 //Bytes returns the post as a single
 //byte array
 func (p *post) Bytes() ([]byte, error) {
-	b, err := p.frontMatter.Json()
-	//add newline after frontmatter
-	b = append(b, byte('\n'))
+	b, err := p.frontMatter.Bytes()
 	if err != nil {
 		return nil, err
 	}
 	return append(b, p.content...), nil
 }
 
-func (p *post) Fname() string {
+//Files returns the post file and its assets
+//keyed by their path in the repo
+func (p *post) Files() (map[string][]byte, error) {
+	b, err := p.Bytes()
+	if err != nil {
+		return nil, errors.New("PostBytes: " + err.Error())
+	}
+	files := map[string][]byte{p.Fname(): b}
+	for _, name := range p.stale {
+		files[path.Join(p.AssetDir(), name)] = nil
+	}
+	for _, a := range p.assets {
+		files[path.Join(p.AssetDir(), a.Name)] = a.Data
+	}
+	return files, nil
+}
+
+//Slug returns the post name used in its file name and
+//url. Existing posts keep their name if their title changes
+func (p *post) Slug() string {
 	if p.frontMatter == nil {
-		panic("cant get post fname because frontmatter is nil")
+		panic("cant get post slug because frontmatter is nil")
+	}
+	if len(p.name) > 0 {
+		return p.name
+	}
+	return strings.ReplaceAll(strings.ToLower(r.ReplaceAllString(p.frontMatter.Title, "")), " ", "-")
+}
+
+func (p *post) Fname() string {
+	if len(p.fname) > 0 {
+		return p.fname
 	}
-	mdname := strings.ReplaceAll(strings.ToLower(r.ReplaceAllString(p.frontMatter.Title, "")), " ", "-")
 	//set file name as
-	return "content/post/" + mdname + ".md"
+	return path.Join(defaultContentDir, p.Slug()+".md")
+}
+
+//AssetDir returns the repo dir the post's assets are stored in
+func (p *post) AssetDir() string {
+	return "static/img/" + p.Slug()
 }
 
+//AssetURL returns the site url of the post asset name
+func (p *post) AssetURL(name string) string {
+	return "/img/" + p.Slug() + "/" + name
+}
+
+//HugoRepo is a hugo site git repository. mu serializes
+//all worktree and git operations and guards changes
 type HugoRepo struct {
-	path   string
+	mu      sync.Mutex
+	path    string
 	baseUrl string
-	repo   *git.Repository
-	auth   *githttp.BasicAuth
-	name   string
-	email  string
-	onDeck *OnDeck
-	test bool
+	repo    *git.Repository
+	auth    transport.AuthMethod
+	name    string
+	email   string
+	test    bool
+	//pending changes keyed by id
+	changes map[string]*change
+	//converter used to turn documents into markdown
+	converter Converter
+	//output of the hugo server
+	output *hugoLog
+	//preview server options
+	preview hugoServerOptions
+	//site dir posts are written to
+	contentDir string
+	//production build run on publish. nil disables building
+	build *BuildConfig
+	//review opens pull requests on forge instead of
+	//pushing to the checked out branch. nil pushes
+	review *ReviewConfig
+	forge  forge
+}
+
+//hugoServerOptions configure the hugo preview server
+type hugoServerOptions struct {
+	//hugo binary to run
+	bin string
+	//port the preview server listens on
+	port string
+	//hugo environment e.g. staging
+	environment string
+	//extra flags appended to the hugo server command
+	flags []string
 }
 
-type OnDeck struct {
+//args returns the hugo server command line arguments.
+//hugo is only reached through the cms proxy so it binds
+//to localhost unless the flags bind it elsewhere
+func (o *hugoServerOptions) args(baseUrl string) []string {
+	args := []string{"server", "--watch=true", "--disableLiveReload", "--buildDrafts", "--buildFuture", "--port", o.port, "--baseURL", baseUrl}
+	bind := true
+	for _, f := range o.flags {
+		if f == "--bind" || strings.HasPrefix(f, "--bind=") {
+			bind = false
+		}
+	}
+	if bind {
+		args = append(args, "--bind", "127.0.0.1")
+	}
+	if len(o.environment) > 0 {
+		args = append(args, "--environment", o.environment)
+	}
+	return append(args, o.flags...)
+}
+
+//change is a post waiting to be published or aborted.
+//Pending changes are written to the worktree so they can
+//be previewed but are only added to the index when they
+//are published so each change is committed on its own
+type change struct {
+	id   string
 	name string
-	msg string
+	msg  string
+	//files keyed by repo path. nil deletes the file
+	files map[string][]byte
+	//future time the change should be published at
+	publishAt time.Time
+	created   time.Time
+	//git author of the change. nil is the repo's identity
+	author *Identity
+	//base is the commit the change was made on. Publishing
+	//fails if the remote changed its files since
+	base plumbing.Hash
 }
 
-func CloneRepo(url string, path string) error {
+//newChangeID returns a random change id
+func newChangeID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic("newChangeID: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+func CloneRepo(url string, path string, auth transport.AuthMethod) error {
 	log.Printf("cloning repo from %s to %s\n", url, path)
 	_, err := git.PlainClone(path, false, &git.CloneOptions{
-		URL:               url,
+		URL:  url,
+		Auth: auth,
 	})
 	return err
 }
 
-func (h *HugoRepo) StartServer(ctx context.Context, stopped chan<- struct{}) (chan error, error) {
-	cmd := exec.CommandContext(ctx, "hugo", "server", "--watch=true","--disableLiveReload","--bind", "0.0.0.0", "--baseURL", h.baseUrl)
+//StartServer starts the hugo preview server returning
+//a channel its exit error is sent on
+func (h *HugoRepo) StartServer(ctx context.Context) (chan error, error) {
+	cmd := exec.CommandContext(ctx, h.preview.bin, h.preview.args(h.baseUrl)...)
 	cmd.Dir = h.path
+	cmd.Stdout = h.output
+	cmd.Stderr = h.output
+	h.output.starting()
 	err := cmd.Start()
 	if err != nil {
 		return nil, err
@@ -188,160 +414,909 @@ func (h *HugoRepo) StartServer(ctx context.Context, stopped chan<- struct{}) (ch
 	go func() {
 		c <- cmd.Wait()
 		log.Println("hugo server stopped")
-		close(stopped)
 	}()
 	return c, nil
 }
 
-func NewHugoRepo(path, username, token, baseUrl, name, email string) (*HugoRepo, error) {
+//Builds returns the number of site builds the hugo
+//server has completed
+func (h *HugoRepo) Builds() uint64 {
+	return h.output.Builds()
+}
+
+//WaitForRebuild waits up to timeout for the hugo server
+//to finish a build after build n returning an error if
+//the build failed
+func (h *HugoRepo) WaitForRebuild(n uint64, timeout time.Duration) error {
+	return h.output.WaitForBuild(n, timeout)
+}
+
+//BuildStatus is the state of the hugo preview build
+type BuildStatus struct {
+	Builds uint64
+	//Failing is set when the last build failed
+	Failing bool
+	//Failure is the most recent failed build
+	Failure *buildFailure
+	//Post the failure was reported in, its url
+	//and its pending change
+	Post    string
+	PostURL string
+	Change  string
+	//Output is the latest hugo output
+	Output []string
+}
+
+//BuildStatus returns the state of the hugo preview build
+//associating the latest failure with a staged post
+func (h *HugoRepo) BuildStatus() *BuildStatus {
+	st := &BuildStatus{Builds: h.output.Builds(), Output: h.output.Lines()}
+	st.Failure, st.Failing = h.output.Failure()
+	if st.Failure != nil && len(st.Failure.File) > 0 {
+		st.Post = postName(st.Failure.File)
+		st.PostURL = h.PostURL(st.Post)
+		if ch := h.ChangeFor(st.Post); ch != nil {
+			st.Change = ch.id
+		}
+	}
+	return st
+}
+
+//NewHugoRepo opens the repo at path authenticating with
+//its remote with auth. nil auth uses no authentication
+func NewHugoRepo(path string, auth transport.AuthMethod, baseUrl, name, email string) (*HugoRepo, error) {
 	repo, err := git.PlainOpen(path)
 	if err != nil {
 		return nil, err
 	}
 	return &HugoRepo{
-		path: path,
-		repo: repo,
-		baseUrl: baseUrl,
-		auth: &githttp.BasicAuth{
-			Username: username,
-			Password: token,
+		converter: &PandocConverter{Path: PandocLoc},
+		path:      path,
+		repo:      repo,
+		baseUrl:   baseUrl,
+		auth:      auth,
+		name:      name,
+		email:     email,
+		changes:   make(map[string]*change),
+		output:    newHugoLog(),
+		preview: hugoServerOptions{
+			bin:  "hugo",
+			port: "1313",
 		},
-		name: name,
-		email: email,
+		contentDir: defaultContentDir,
 	}, nil
 }
 
 func (h *HugoRepo) writeFile(fname string, b []byte) error {
-	return ioutil.WriteFile(path.Join(h.path, fname), b, 0644)
+	fpath := path.Join(h.path, fname)
+	if err := os.MkdirAll(path.Dir(fpath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fpath, b, 0644)
+}
+
+//postFile returns the repo path of post name.
+//Names from users must be checked by validPostName
+func (h *HugoRepo) postFile(name string) string {
+	return path.Join(h.contentDir, name+".md")
+}
+
+//section returns the site section posts are published in
+func (h *HugoRepo) section() string {
+	return strings.TrimPrefix(path.Clean(h.contentDir), "content/")
+}
+
+//PostURL returns the site url path of post name
+func (h *HugoRepo) PostURL(name string) string {
+	return "/" + h.section() + "/" + name + "/"
 }
 
 func (h *HugoRepo) readFile(fname string) ([]byte, error) {
 	return ioutil.ReadFile(path.Join(h.path, fname))
 }
 
-func (h *HugoRepo) stageChange(post *post) error {
-	//reset in case there are any lingering changes
-	err := h.Abort()
+//stageChange adds post as a pending change with a
+//commit message of verb followed by the post name.
+//A post can only have one pending change so staging
+//a post again replaces its pending change.
+//The caller must hold h.mu
+func (h *HugoRepo) stageChange(post *post, verb string, author *Identity) (*change, error) {
+	files, err := post.Files()
 	if err != nil {
-		return errors.New("abort: " + err.Error())
+		return nil, err
 	}
+	name := postName(post.Fname())
+	return h.stage(&change{
+		id:        newChangeID(),
+		name:      name,
+		msg:       verb + " " + name,
+		files:     files,
+		publishAt: post.frontMatter.PublishDate,
+		created:   time.Now(),
+		author:    author,
+	})
+}
 
-	//get work tree
-	wt, err := h.repo.Worktree()
+//stage adds ch as a pending change replacing the pending
+//change of the same post by the same author. A pending
+//change by another author isn't replaced so authors can't
+//discard each other's work. The caller must hold h.mu
+func (h *HugoRepo) stage(ch *change) (*change, error) {
+	head, err := h.repo.Head()
 	if err != nil {
-		return errors.New("worktree: " + err.Error())
+		return nil, err
 	}
-
-	//pull down any changes on remote
-	if err = wt.Pull(&git.PullOptions{RemoteName:"origin"}); err != nil {
-		if err != git.NoErrAlreadyUpToDate {
-			return errors.New("git pull: " + err.Error())
+	//the post was read from HEAD or the change it replaces
+	ch.base = head.Hash()
+	var replaced *change
+	for _, c := range h.changes {
+		if c.name != ch.name {
+			continue
+		}
+		if !sameAuthor(c.author, ch.author) {
+			return nil, fmt.Errorf("%s %w by %s. Publish or abort it first", ch.name, errPendingChange, h.authorName(c.author))
+		}
+		replaced = c
+		ch.base = c.base
+	}
+	if replaced != nil {
+		delete(h.changes, replaced.id)
+	}
+	h.changes[ch.id] = ch
+	if err := h.sync(true); err != nil {
+		delete(h.changes, ch.id)
+		if replaced != nil {
+			h.changes[replaced.id] = replaced
 		}
+		return nil, err
 	}
+	return ch, nil
+}
 
-	fname := post.Fname()
-	b, err := post.Bytes()
-	if err != nil {
-		return errors.New("PostBytes: " + err.Error())
+//sameAuthor reports whether a and b are the same git author.
+//nil is the repo's identity used when sign in is disabled
+func sameAuthor(a, b *Identity) bool {
+	if a == nil || b == nil {
+		return a == b
 	}
-	err = h.writeFile(fname, b)
-	if err != nil {
-		return err
+	return strings.EqualFold(a.Email, b.Email)
+}
+
+//authorName returns the name of git author a
+func (h *HugoRepo) authorName(a *Identity) string {
+	if a == nil {
+		return h.name
 	}
+	return a.Name
+}
 
-	//stage changes
-	_, err = wt.Add(fname)
+//sync resets the worktree to HEAD, optionally pulls
+//from the remote, then writes all pending changes
+func (h *HugoRepo) sync(pull bool) error {
+	//reset in case there are any lingering changes
+	err := h.reset()
 	if err != nil {
-		return err
+		return errors.New("reset: " + err.Error())
 	}
 
-	//set on deck name to just the name of the post file
-	//no extension
-	nparts := strings.Split(fname, "/")
-	name := nparts[len(nparts) -1]
-	name = name[:len(name)-3]
-	h.onDeck = &OnDeck{name: name}
+	if pull {
+		//get work tree
+		wt, err := h.repo.Worktree()
+		if err != nil {
+			return errors.New("worktree: " + err.Error())
+		}
+
+		//pull down any changes on remote
+		if err = wt.Pull(&git.PullOptions{RemoteName: "origin", Auth: h.auth}); err != nil {
+			if err != git.NoErrAlreadyUpToDate {
+				return errors.New("git pull: " + err.Error())
+			}
+		}
+	}
+	return h.writeChanges()
+}
 
+//writeChanges writes the files of all pending
+//changes to the worktree
+func (h *HugoRepo) writeChanges() error {
+	for _, c := range h.changes {
+		for fname, b := range c.files {
+			if err := h.applyFile(fname, b); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-func (h *HugoRepo) New(c io.Reader, title, tags, summary, author string) error {
+//applyFile writes b to fname or removes fname if b is nil
+func (h *HugoRepo) applyFile(fname string, b []byte) error {
+	if b != nil {
+		return h.writeFile(fname, b)
+	}
+	err := os.Remove(path.Join(h.path, fname))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//postName returns the name of a post file
+//without its dir or extension
+func postName(fname string) string {
+	return strings.TrimSuffix(path.Base(fname), path.Ext(fname))
+}
+
+func (h *HugoRepo) New(c io.Reader, mime string, d *postDetails) (*change, error) {
 	//create post file
-	post, err := newPost(c, title, tags, summary, author)
+	post, err := newPost(h.converter, c, mime, "", d)
 	if err != nil {
-		return errors.New("newPost: " + err.Error())
+		return nil, errors.New("newPost: " + err.Error())
 	}
 
-	return h.stageChange(post)
+	post.fname = h.postFile(post.Slug())
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch, err := h.stageChange(post, "published", d.GitAuthor)
+	if err != nil {
+		return nil, err
+	}
+	return ch.snapshot(), nil
 }
 
 func (h *HugoRepo) GetPost(name string) (*post, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.getPost(name)
+}
+
+func (h *HugoRepo) getPost(name string) (*post, error) {
+	//the name is used in paths that are written and removed
+	if err := validPostName(name); err != nil {
+		return nil, err
+	}
 	//build file name
-	b, err := h.readFile("content/post/" + name + ".md")
+	fname := h.postFile(name)
+	b, err := h.readFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	p, err := existingPost(b)
 	if err != nil {
 		return nil, err
 	}
-	return existingPost(b)
+	p.fname = fname
+	p.name = name
+	return p, nil
 }
 
-func (h *HugoRepo) Update(c io.Reader, name, title, tags, summary, author string) error {
+func (h *HugoRepo) Update(c io.Reader, mime, name string, d *postDetails) (*change, error) {
 	post, err := h.GetPost(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	npost, err := newPost(c, title, tags, summary, author)
+	npost, err := newPost(h.converter, c, mime, post.Slug(), d)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	npost = updatedPost(post, npost, d)
+	//remove the assets of the current version
+	//except for a cover the update keeps
+	assets, err := h.assetFiles(npost)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range assets {
+		if npost.frontMatter.Img != npost.AssetURL(a) {
+			npost.stale = append(npost.stale, a)
+		}
+	}
+	ch, err := h.stageChange(npost, "updated", d.GitAuthor)
+	if err != nil {
+		return nil, err
+	}
+	return ch.snapshot(), nil
+}
+
+//assetFiles returns the names of the files in the
+//worktree's asset dir of post p. The caller must hold h.mu
+func (h *HugoRepo) assetFiles(p *post) ([]string, error) {
+	infos, err := ioutil.ReadDir(path.Join(h.path, p.AssetDir()))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+//Delete stages the removal of post name and its assets
+func (h *HugoRepo) Delete(name string, author *Identity) (*change, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	post, err := h.getPost(name)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]byte{post.Fname(): nil}
+	assets, err := h.assetFiles(post)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range assets {
+		files[path.Join(post.AssetDir(), a)] = nil
+	}
+	ch, err := h.stage(&change{
+		id:      newChangeID(),
+		name:    name,
+		msg:     "deleted " + name,
+		files:   files,
+		created: time.Now(),
+		author:  author,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ch.snapshot(), nil
+}
+
+//Posts returns the posts in the worktree's content dir
+//including pending changes
+func (h *HugoRepo) Posts() ([]*post, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	infos, err := ioutil.ReadDir(path.Join(h.path, h.contentDir))
+	if err != nil {
+		return nil, err
+	}
+	var posts []*post
+	for _, info := range infos {
+		name := info.Name()
+		//posts the cms can't address by name are left out
+		if info.IsDir() || path.Ext(name) != ".md" || validPostName(postName(name)) != nil {
+			continue
+		}
+		p, err := h.getPost(postName(name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		posts = append(posts, p)
+	}
+	return posts, nil
+}
+
+//updatedPost returns the new post np with the front
+//matter of the existing post p updated with the details d.
+//Front matter the form doesn't set such as the date and
+//any keys the cms doesn't model are kept
+func updatedPost(p, np *post, d *postDetails) *post {
+	fm := *p.frontMatter
+	fm.Title = np.frontMatter.Title
+	fm.Summary = np.frontMatter.Summary
+	fm.Tags = np.frontMatter.Tags
+	fm.Draft = np.frontMatter.Draft
+	if !d.Date.IsZero() {
+		fm.Date = d.Date
+		fm.PublishDate = d.Date
+	}
+	if len(np.frontMatter.Author) > 0 {
+		fm.Author = np.frontMatter.Author
+	}
+	//keep the current cover unless a new one was chosen.
+	//Choosing the first image of a document without
+	//images doesn't set one
+	if d.Cover != nil && len(np.frontMatter.Img) > 0 {
+		fm.Img = np.frontMatter.Img
+	}
+	np.frontMatter = &fm
+	//write the post back to the file it was read from
+	np.fname = p.fname
+	return np
+}
+
+//Promote publishes the draft post name by clearing its
+//draft flag and deploying it returning the url of its
+//pull request in review mode
+func (h *HugoRepo) Promote(name string, author *Identity) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	post, err := h.getPost(name)
+	if err != nil {
+		return "", err
+	}
+	if !post.frontMatter.Draft {
+		return "", fmt.Errorf("%s is not a draft", name)
+	}
+	post.frontMatter.Draft = false
+	files, err := post.Files()
+	if err != nil {
+		return "", err
+	}
+	//the post read from the worktree includes its pending
+	//change so keep the change's other files such as images
+	for _, c := range h.changes {
+		if c.name != name {
+			continue
+		}
+		for fname, b := range c.files {
+			if _, ok := files[fname]; !ok {
+				files[fname] = b
+			}
+		}
+	}
+	ch, err := h.stage(&change{
+		id:        newChangeID(),
+		name:      name,
+		msg:       "promoted draft " + name,
+		files:     files,
+		publishAt: post.frontMatter.PublishDate,
+		created:   time.Now(),
+		author:    author,
+	})
+	if err != nil {
+		return "", err
+	}
+	return h.publish(ch.id)
+}
+
+//snapshot returns a copy of c safe to read
+//without holding the repo lock. files are never
+//modified after staging so they aren't copied
+func (c *change) snapshot() *change {
+	cp := *c
+	return &cp
+}
+
+//Changes returns the pending changes oldest first
+func (h *HugoRepo) Changes() []*change {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	changes := make([]*change, 0, len(h.changes))
+	for _, c := range h.changes {
+		changes = append(changes, c.snapshot())
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].created.Before(changes[j].created)
+	})
+	return changes
+}
+
+//Change returns the pending change id
+func (h *HugoRepo) Change(id string) (*change, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, err := h.change(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.snapshot(), nil
+}
+
+func (h *HugoRepo) change(id string) (*change, error) {
+	c, ok := h.changes[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", errNoChange, id)
+	}
+	return c, nil
+}
+
+//ChangeFor returns the pending change for the post name
+//or nil if it doesn't have one
+func (h *HugoRepo) ChangeFor(name string) *change {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, c := range h.changes {
+		if c.name == name {
+			return c.snapshot()
+		}
+	}
+	return nil
+}
+
+//SetMessage sets the commit message of change id
+func (h *HugoRepo) SetMessage(id, msg string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, err := h.change(id)
 	if err != nil {
 		return err
 	}
-	//copy old post date to new
-	npost.frontMatter.Date = post.frontMatter.Date
+	c.msg = msg
+	return nil
+}
+
+//Schedule removes change id from the worktree
+//returning it to be published at its publish date
+func (h *HugoRepo) Schedule(id string) (*scheduledPost, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, err := h.change(id)
+	if err != nil {
+		return nil, err
+	}
+	delete(h.changes, id)
+	sp := &scheduledPost{
+		Name:   c.name,
+		Msg:    c.msg,
+		At:     c.publishAt,
+		Files:  c.files,
+		Author: c.author,
+	}
+	if !c.base.IsZero() {
+		sp.Base = c.base.String()
+	}
+	return sp, h.sync(false)
+}
 
-	return h.stageChange(npost)
+//Publish commits and pushes change id returning the
+//url of its pull request in review mode. If only pushing
+//the built site fails the change is still published and
+//an error wrapping errSitePush is returned
+func (h *HugoRepo) Publish(id string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.publish(id)
 }
 
-func (h *HugoRepo) Deploy() error {
+func (h *HugoRepo) publish(id string) (string, error) {
+	c, err := h.change(id)
+	if err != nil {
+		return "", err
+	}
+	pr, err := h.deploy(c)
+	if err != nil && !errors.Is(err, errSitePush) {
+		return "", err
+	}
+	delete(h.changes, id)
+	if h.review != nil {
+		//the change is only on its pull request branch
+		return pr, h.sync(false)
+	}
+	return pr, err
+}
+
+//PublishFiles commits and pushes files of post name which
+//aren't part of a pending change returning the url of its
+//pull request in review mode. base is the hash of the
+//commit the files were changed on. Empty skips checking
+//for conflicting remote changes. Errors pushing the built
+//site are returned like Publish
+func (h *HugoRepo) PublishFiles(name, msg, base string, files map[string][]byte, author *Identity) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.deploy(&change{name: name, msg: msg, files: files, author: author, base: plumbing.NewHash(base)})
+}
+
+//deploy rebases change c onto the remote then commits only
+//its files and pushes the commit to the remote or opens a
+//pull request for it in review mode returning its url. The
+//commit is authored by the change's author and committed
+//by the repo's identity. If the push is rejected because
+//the remote moved on the commit is recreated on top of it
+func (h *HugoRepo) deploy(c *change) (string, error) {
+	for attempt := 1; ; attempt++ {
+		remote, err := h.rebase(c)
+		if err != nil {
+			return "", err
+		}
+		parent, err := h.commit(c)
+		if err != nil {
+			return "", err
+		}
+		//push the commit to a branch for review leaving
+		//the checked out branch as it was
+		if h.review != nil {
+			var pr string
+			if !h.test {
+				pr, err = h.openPullRequest(c)
+			}
+			if rerr := h.dropCommit(parent); rerr != nil && err == nil {
+				err = rerr
+			}
+			return pr, err
+		}
+		//build the site before pushing so a broken
+		//build is never published
+		if h.build != nil && len(h.build.Mode) > 0 {
+			//remove other pending changes from the build
+			err = h.reset()
+			if err == nil {
+				err = h.buildSite(c.msg)
+			}
+			if err != nil {
+				//drop the commit so the change stays pending
+				if rerr := h.dropCommit(parent); rerr != nil {
+					log.Println("error removing commit of failed build: ", rerr)
+				}
+				return "", err
+			}
+		}
+		//restore other pending changes which
+		//may share files with this one
+		if err = h.writeChanges(); err != nil {
+			return "", err
+		}
+		if h.test {
+			return "", nil
+		}
+
+		//push to remote
+		err = h.repo.PushContext(context.TODO(), &git.PushOptions{
+			Auth: h.auth,
+		})
+		if err == nil {
+			if err = h.pushSite(); err != nil {
+				//the change is live so only the site is out of date
+				return "", fmt.Errorf("%w: %s", errSitePush, err)
+			}
+			return "", nil
+		}
+		//drop the commit so the change stays pending
+		//instead of being left unpushed
+		if rerr := h.dropCommit(parent); rerr != nil {
+			log.Println("error removing commit of failed push: ", rerr)
+		}
+		//retry if the push was rejected as someone pushed since the fetch
+		if attempt == maxDeployAttempts {
+			return "", err
+		}
+		if moved, ferr := h.fetch(); ferr != nil || moved == remote {
+			return "", err
+		}
+		log.Printf("push of %s rejected as the remote changed. rebasing\n", c.name)
+	}
+}
+
+//rebase resets the worktree and fast forwards the checked
+//out branch to the remote's head returning it. It returns
+//an error wrapping errConflict if the remote changed the
+//files of change c since c was staged
+func (h *HugoRepo) rebase(c *change) (plumbing.Hash, error) {
+	remote, err := h.fastForward()
+	//restore the pending changes even if fast forwarding failed
+	if werr := h.writeChanges(); werr != nil && err == nil {
+		err = werr
+	}
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	files, err := h.conflicts(c)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if len(files) > 0 {
+		return plumbing.ZeroHash, fmt.Errorf("%s %w to %s. Abort the change and edit the latest version of the post",
+			c.name, errConflict, strings.Join(files, ", "))
+	}
+	return remote, nil
+}
+
+//fastForward resets the worktree and moves the checked out
+//branch to the remote's head if it is behind it
+func (h *HugoRepo) fastForward() (plumbing.Hash, error) {
+	if err := h.reset(); err != nil {
+		return plumbing.ZeroHash, errors.New("reset: " + err.Error())
+	}
+	remote, err := h.fetch()
+	if err != nil || remote.IsZero() {
+		return remote, err
+	}
+	head, err := h.repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if head.Hash() == remote {
+		return remote, nil
+	}
+	//commits which haven't been pushed yet
+	ahead, err := h.isAncestor(remote, head.Hash())
+	if err != nil || ahead {
+		return remote, err
+	}
+	behind, err := h.isAncestor(head.Hash(), remote)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if !behind {
+		return plumbing.ZeroHash, fmt.Errorf("%s has diverged from origin", head.Name().Short())
+	}
 	wt, err := h.repo.Worktree()
 	if err != nil {
-		return err
+		return plumbing.ZeroHash, err
+	}
+	return remote, wt.Reset(&git.ResetOptions{Commit: remote, Mode: git.HardReset})
+}
+
+//fetch fetches origin returning the head of its branch of
+//the same name as the checked out branch or the zero hash
+//if it doesn't have one
+func (h *HugoRepo) fetch() (plumbing.Hash, error) {
+	err := h.repo.Fetch(&git.FetchOptions{RemoteName: "origin", Auth: h.auth})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return plumbing.ZeroHash, errors.New("git fetch: " + err.Error())
+	}
+	head, err := h.repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	ref, err := h.repo.Reference(plumbing.NewRemoteReferenceName("origin", head.Name().Short()), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return plumbing.ZeroHash, nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return ref.Hash(), nil
+}
+
+//isAncestor reports whether commit a is an ancestor of commit b
+func (h *HugoRepo) isAncestor(a, b plumbing.Hash) (bool, error) {
+	commit, err := h.repo.CommitObject(b)
+	if err != nil {
+		return false, err
+	}
+	found := false
+	err = object.NewCommitPreorderIter(commit, nil, nil).ForEach(func(c *object.Commit) error {
+		if c.Hash == a {
+			found = true
+			return storer.ErrStop
+		}
+		return nil
+	})
+	return found, err
+}
+
+//conflicts returns the files of change c which HEAD changed
+//since the commit c was staged on. Files HEAD changed to
+//the same content as c don't conflict
+func (h *HugoRepo) conflicts(c *change) ([]string, error) {
+	if c.base.IsZero() {
+		return nil, nil
+	}
+	head, err := h.repo.Head()
+	if err != nil || head.Hash() == c.base {
+		return nil, err
+	}
+	base, err := h.commitTree(c.base)
+	if err != nil {
+		return nil, err
+	}
+	current, err := h.commitTree(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for fname, b := range c.files {
+		now := treeFileHash(current, fname)
+		if now == treeFileHash(base, fname) {
+			continue
+		}
+		if b == nil && now.IsZero() || b != nil && now == plumbing.ComputeHash(plumbing.BlobObject, b) {
+			continue
+		}
+		files = append(files, fname)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+//commitTree returns the tree of commit hash
+func (h *HugoRepo) commitTree(hash plumbing.Hash) (*object.Tree, error) {
+	commit, err := h.repo.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
+
+//treeFileHash returns the blob hash of fname in tree
+//or the zero hash if tree doesn't have it
+func treeFileHash(tree *object.Tree, fname string) plumbing.Hash {
+	e, err := tree.FindEntry(fname)
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+	return e.Hash
+}
+
+//commit commits the files of change c returning the
+//hash of the commit it was committed on top of
+func (h *HugoRepo) commit(c *change) (plumbing.Hash, error) {
+	wt, err := h.repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	//stage the change's files
+	for fname, b := range c.files {
+		if err = h.applyFile(fname, b); err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if b == nil {
+			_, err = wt.Remove(fname)
+			if err == index.ErrEntryNotFound {
+				err = nil
+			}
+		} else {
+			_, err = wt.Add(fname)
+		}
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
 	}
-	//if index is clean return error
+	//if the files match HEAD return error
 	st, err := wt.Status()
 	if err != nil {
-		return err
+		return plumbing.ZeroHash, err
+	}
+	staged := false
+	for fname := range c.files {
+		if s := st.File(fname); s.Staging != git.Unmodified && s.Staging != git.Untracked {
+			staged = true
+		}
 	}
-	if st.IsClean() {
-		h.onDeck = nil
-		return errors.New("index is clean")
+	if !staged {
+		return plumbing.ZeroHash, errors.New("change doesn't modify any files")
 	}
 
+	parent, err := h.repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
 	//add commit
-	if h.onDeck == nil {
-		return errors.New("went to commit but onDeck is empty")
-	}
-	_, err = wt.Commit(h.onDeck.msg, &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  h.name,
-			Email: h.email,
-			When: time.Now(),
-		},
+	committer := &object.Signature{
+		Name:  h.name,
+		Email: h.email,
+		When:  time.Now(),
+	}
+	sig := committer
+	if c.author != nil {
+		sig = &object.Signature{Name: c.author.Name, Email: c.author.Email, When: committer.When}
+	}
+	_, err = wt.Commit(c.msg, &git.CommitOptions{
+		Author:    sig,
+		Committer: committer,
 	})
 	if err != nil {
-		return errors.New("error committing to repo: " + err.Error())
+		return plumbing.ZeroHash, errors.New("error committing to repo: " + err.Error())
 	}
+	return parent.Hash(), nil
+}
 
-	//push to remote
-	if !h.test {
-		return h.repo.PushContext(context.TODO(), &git.PushOptions{
-			Auth: h.auth,
-		})
+//dropCommit resets the checked out branch to parent
+//removing the commit on top of it and restores the
+//pending changes to the worktree
+func (h *HugoRepo) dropCommit(parent plumbing.Hash) error {
+	wt, err := h.repo.Worktree()
+	if err != nil {
+		return err
 	}
-	h.onDeck = nil
-	return nil
+	if err = wt.Reset(&git.ResetOptions{Commit: parent, Mode: git.HardReset}); err != nil {
+		return err
+	}
+	return h.writeChanges()
+}
+
+//Abort discards change id
+func (h *HugoRepo) Abort(id string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.change(id); err != nil {
+		return err
+	}
+	delete(h.changes, id)
+	return h.sync(false)
 }
 
-func (h *HugoRepo) Abort() error {
-	h.onDeck = nil
-	//unstage changes and clean directory
+//reset unstages changes and cleans the worktree
+func (h *HugoRepo) reset() error {
 	head, err := h.repo.Head()
 	if err != nil {
 		return err
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+//stubConverter returns a fixed conversion
+type stubConverter struct {
+	conv *Conversion
+}
+
+func (s *stubConverter) Convert(c io.Reader, mime string) (*Conversion, error) {
+	return s.conv, nil
+}
+
+func TestNewPostAssets(t *testing.T) {
+	conv := &stubConverter{&Conversion{
+		Markdown: []byte("![](media/image1.png)\n\n<img src=\"media/image2.jpeg\" style=\"width:1in\" />\n"),
+		Assets: []*Asset{
+			{Name: "media/image1.png", Data: []byte("png")},
+			{Name: "media/image2.jpeg", Data: []byte("jpeg")},
+		},
+	}}
+	p, err := newPost(conv, strings.NewReader(""), docxMIME, "", &postDetails{Title: "My Post!", Tags: "a b"})
+	if err != nil {
+		t.Fatal("error creating post: ", err)
+	}
+	if dir := p.AssetDir(); dir != "static/img/my-post" {
+		t.Errorf("unexpected asset dir: %s", dir)
+	}
+	expected := "![](/img/my-post/image1.png)\n\n<img src=\"/img/my-post/image2.jpeg\" style=\"width:1in\" />\n"
+	if string(p.content) != expected {
+		t.Errorf("asset references not rewritten: got\n%s", p.content)
+	}
+	if len(p.assets) != 2 || p.assets[0].Name != "image1.png" || p.assets[1].Name != "image2.jpeg" {
+		t.Errorf("unexpected post assets: %v", p.assets)
+	}
+}
+
+func TestNewPostAssetNames(t *testing.T) {
+	//images with the same name from different folders
+	conv := &stubConverter{&Conversion{
+		Markdown: []byte("![](a/image.png)\n\n![](b/image.png)\n"),
+		Assets: []*Asset{
+			{Name: "a/image.png", Data: []byte("a")},
+			{Name: "b/image.png", Data: []byte("b")},
+		},
+	}}
+	p, err := newPost(conv, strings.NewReader(""), docxMIME, "", &postDetails{Title: "Names"})
+	if err != nil {
+		t.Fatal("error creating post: ", err)
+	}
+	files, err := p.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(files["static/img/names/image.png"]) != "a" || string(files["static/img/names/1-image.png"]) != "b" {
+		t.Errorf("assets with the same name overwritten: %v", files)
+	}
+	expected := "![](/img/names/image.png)\n\n![](/img/names/1-image.png)\n"
+	if string(p.content) != expected {
+		t.Errorf("asset references not rewritten: got\n%s", p.content)
+	}
+}
+
+func TestNewPostCover(t *testing.T) {
+	conv := &stubConverter{&Conversion{
+		Markdown: []byte("![](media/image1.png)\n"),
+		Assets:   []*Asset{{Name: "media/image1.png", Data: []byte("png")}},
+	}}
+	covers := map[string]*Cover{
+		"":                      nil,
+		"/img/cover/image1.png": {FirstImage: true},
+		"/img/cover/cover.jpg":  {Name: "Photo.JPG", Data: []byte("jpg")},
+		//uploads without an extension use their detected type
+		"/img/cover/cover.png": {Name: "cover", Data: []byte("\x89PNG\r\n\x1a\n")},
+	}
+	for expected, cover := range covers {
+		p, err := newPost(conv, strings.NewReader(""), docxMIME, "", &postDetails{Title: "Cover", Cover: cover})
+		if err != nil {
+			t.Fatal("error creating post: ", err)
+		}
+		if p.frontMatter.Img != expected {
+			t.Errorf("expected Img %q got %q", expected, p.frontMatter.Img)
+		}
+	}
+	cover := &Cover{Name: "notes.txt", Data: []byte("not an image")}
+	if _, err := newPost(conv, strings.NewReader(""), docxMIME, "", &postDetails{Title: "Cover", Cover: cover}); err == nil {
+		t.Error("expected error using a text file as cover")
+	}
+}
+
+func TestUpdatedPost(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/update-post.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := existingPost(b)
+	if err != nil {
+		t.Fatal("error parsing fixture: ", err)
+	}
+	conv := &stubConverter{&Conversion{Markdown: []byte("New content.\n")}}
+	d := &postDetails{Title: "Original Title", Summary: "a new summary", Tags: "new tags", Draft: true}
+	np, err := newPost(conv, strings.NewReader(""), docxMIME, "", d)
+	if err != nil {
+		t.Fatal("error creating post: ", err)
+	}
+	p := updatedPost(old, np, d)
+
+	//write and re-read the post to check the round trip
+	b, err = p.Bytes()
+	if err != nil {
+		t.Fatal("error writing post: ", err)
+	}
+	p, err = existingPost(b)
+	if err != nil {
+		t.Fatalf("error parsing updated post: %s\n%s", err, b)
+	}
+	fm := p.frontMatter
+	if fm.format != fmYAML {
+		t.Errorf("front matter format changed to %s", fm.format)
+	}
+	if fm.Summary != "a new summary" || fm.TagList() != "new tags" || !fm.Draft {
+		t.Errorf("form fields not updated: %+v", fm)
+	}
+	if fm.Author != "Original Author" || fm.Img != "/img/original-title/cover.png" {
+		t.Errorf("unset fields not kept: %+v", fm)
+	}
+	if !fm.Date.Equal(old.frontMatter.Date) {
+		t.Errorf("date changed from %s to %s", old.frontMatter.Date, fm.Date)
+	}
+	for _, k := range []string{"aliases", "categories", "series", "weight"} {
+		if _, ok := fm.extra[k]; !ok {
+			t.Errorf("front matter key %s was lost", k)
+		}
+	}
+	if string(p.content) != "New content.\n" {
+		t.Errorf("unexpected content %q", p.content)
+	}
+
+	//the first image of a document without images keeps the cover
+	d.Cover = &Cover{FirstImage: true}
+	if np, err = newPost(conv, strings.NewReader(""), docxMIME, "", d); err != nil {
+		t.Fatal("error creating post: ", err)
+	}
+	if img := updatedPost(old, np, d).frontMatter.Img; img != "/img/original-title/cover.png" {
+		t.Errorf("cover replaced with %q", img)
+	}
+}
+
+//testRepo returns a HugoRepo cloned from a local
+//origin repo with a single commit
+func testRepo(t *testing.T) *HugoRepo {
+	dir, err := ioutil.TempDir("", "blogposter-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	//create the initial commit in a seed repo
+	seed := path.Join(dir, "seed")
+	repo, err := git.PlainInit(seed, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(path.Join(seed, "content", "post"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("testdata/update-post.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path.Join(seed, "content", "post", "original-title.md"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = wt.Add("content/post/original-title.md"); err != nil {
+		t.Fatal(err)
+	}
+	sig := &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}
+	if _, err = wt.Commit("initial commit", &git.CommitOptions{Author: sig}); err != nil {
+		t.Fatal(err)
+	}
+
+	//clone a bare origin and the working repo from it
+	origin := path.Join(dir, "origin")
+	if _, err = git.PlainClone(origin, true, &git.CloneOptions{URL: seed}); err != nil {
+		t.Fatal(err)
+	}
+	local := path.Join(dir, "local")
+	if err = CloneRepo(origin, local, nil); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHugoRepo(local, nil, "", "test", "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.converter = &stubConverter{&Conversion{Markdown: []byte("content\n")}}
+	return h
+}
+
+//headFiles returns the files changed by the HEAD commit
+func headFiles(t *testing.T, h *HugoRepo) []string {
+	ref, err := h.repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := h.repo.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := commit.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, s := range stats {
+		files = append(files, s.Name)
+	}
+	return files
+}
+
+func TestConcurrentChanges(t *testing.T) {
+	h := testRepo(t)
+	first, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "First"})
+	if err != nil {
+		t.Fatal("error staging first post: ", err)
+	}
+	second, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Second"})
+	if err != nil {
+		t.Fatal("error staging second post: ", err)
+	}
+	if len(h.Changes()) != 2 {
+		t.Fatalf("expected 2 pending changes got %d", len(h.Changes()))
+	}
+	//both changes are in the worktree for previewing
+	for _, name := range []string{"first", "second"} {
+		if _, err = h.GetPost(name); err != nil {
+			t.Errorf("pending post %s not in worktree: %s", name, err)
+		}
+	}
+
+	//publishing a change only commits its files
+	if _, err = h.Publish(second.id); err != nil {
+		t.Fatal("error publishing second post: ", err)
+	}
+	if files := headFiles(t, h); len(files) != 1 || files[0] != "content/post/second.md" {
+		t.Errorf("unexpected files in publish commit: %v", files)
+	}
+	if _, err = h.GetPost("first"); err != nil {
+		t.Errorf("pending post removed from worktree by publish: %s", err)
+	}
+
+	//aborting removes only the aborted change
+	if err = h.Abort(first.id); err != nil {
+		t.Fatal("error aborting first post: ", err)
+	}
+	if _, err = h.GetPost("first"); !os.IsNotExist(err) {
+		t.Errorf("aborted post still in worktree: %v", err)
+	}
+	if _, err = h.GetPost("second"); err != nil {
+		t.Errorf("published post missing: %s", err)
+	}
+	if len(h.Changes()) != 0 {
+		t.Errorf("expected no pending changes got %d", len(h.Changes()))
+	}
+	if _, err = h.Publish(first.id); err == nil {
+		t.Error("expected error publishing aborted change")
+	}
+}
+
+func TestRestageReplacesChange(t *testing.T) {
+	h := testRepo(t)
+	//the same author restaging replaces their own change
+	first, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Post"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Post", Summary: "again"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.Change(first.id); err == nil {
+		t.Error("restaged post kept its old change")
+	}
+	if c := h.ChangeFor("post"); c == nil || c.id != second.id {
+		t.Errorf("expected change %s for post got %v", second.id, c)
+	}
+}
+
+func TestPendingChangeOtherAuthor(t *testing.T) {
+	h := testRepo(t)
+	alice := &Identity{Name: "Alice", Email: "alice@example.com"}
+	bob := &Identity{Name: "Bob", Email: "bob@example.com"}
+	first, err := h.Update(strings.NewReader(""), docxMIME, "original-title", &postDetails{Title: "Original Title", Summary: "alice", GitAuthor: alice})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.Update(strings.NewReader(""), docxMIME, "original-title", &postDetails{Title: "Original Title", Summary: "bob", GitAuthor: bob})
+	if !errors.Is(err, errPendingChange) || !strings.Contains(err.Error(), "Alice") {
+		t.Fatalf("expected pending change by Alice error got %v", err)
+	}
+	if _, err = h.Change(first.id); err != nil {
+		t.Errorf("first author's change discarded: %s", err)
+	}
+	p, err := h.GetPost("original-title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.frontMatter.Summary != "alice" {
+		t.Errorf("expected first author's change in worktree got summary %q", p.frontMatter.Summary)
+	}
+	//the first author can still restage
+	second, err := h.Update(strings.NewReader(""), docxMIME, "original-title", &postDetails{Title: "Original Title", Summary: "again", GitAuthor: alice})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := h.ChangeFor("original-title"); c == nil || c.id != second.id {
+		t.Errorf("expected change %s for post got %v", second.id, c)
+	}
+}
+
+func TestRenamePost(t *testing.T) {
+	h := testRepo(t)
+	h.converter = &stubConverter{&Conversion{
+		Markdown: []byte("![](media/image1.png)\n"),
+		Assets:   []*Asset{{Name: "media/image1.png", Data: []byte("png")}},
+	}}
+	ch, err := h.Update(strings.NewReader(""), docxMIME, "original-title", &postDetails{Title: "Renamed Title"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.name != "original-title" {
+		t.Errorf("renamed post staged as %s", ch.name)
+	}
+	var files []string
+	for fname := range ch.files {
+		files = append(files, fname)
+	}
+	sort.Strings(files)
+	if strings.Join(files, " ") != "content/post/original-title.md static/img/original-title/image1.png" {
+		t.Errorf("renamed post not kept in its files: %v", files)
+	}
+	p, err := h.GetPost("original-title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.frontMatter.Title != "Renamed Title" || !strings.Contains(string(p.content), "/img/original-title/image1.png") {
+		t.Errorf("unexpected renamed post %+v\n%s", p.frontMatter, p.content)
+	}
+}
+
+func TestUpdateRemovesOldAssets(t *testing.T) {
+	h := testRepo(t)
+	h.converter = &stubConverter{&Conversion{
+		Markdown: []byte("![](media/image1.png)\n\n![](media/image2.png)\n"),
+		Assets: []*Asset{
+			{Name: "media/image1.png", Data: []byte("png1")},
+			{Name: "media/image2.png", Data: []byte("png2")},
+		},
+	}}
+	cover := &Cover{Name: "cover.jpg", Data: []byte("jpg")}
+	ch, err := h.Update(strings.NewReader(""), docxMIME, "original-title", &postDetails{Title: "Original Title", Cover: cover})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.Publish(ch.id); err != nil {
+		t.Fatal("error publishing first version: ", err)
+	}
+
+	//the new version drops an image and keeps the cover
+	h.converter = &stubConverter{&Conversion{
+		Markdown: []byte("![](media/image1.png)\n"),
+		Assets:   []*Asset{{Name: "media/image1.png", Data: []byte("new")}},
+	}}
+	if ch, err = h.Update(strings.NewReader(""), docxMIME, "original-title", &postDetails{Title: "Original Title"}); err != nil {
+		t.Fatal(err)
+	}
+	dir := "static/img/original-title/"
+	if b, ok := ch.files[dir+"image2.png"]; !ok || b != nil {
+		t.Errorf("old asset not removed: %v", ch.files)
+	}
+	if string(ch.files[dir+"image1.png"]) != "new" {
+		t.Errorf("new asset not written: %v", ch.files)
+	}
+	if _, ok := ch.files[dir+"cover.jpg"]; ok {
+		t.Errorf("kept cover changed: %v", ch.files)
+	}
+	if _, err = h.Publish(ch.id); err != nil {
+		t.Fatal("error publishing second version: ", err)
+	}
+	if _, err = os.Stat(path.Join(h.path, dir, "image2.png")); !os.IsNotExist(err) {
+		t.Errorf("old asset still in worktree: %v", err)
+	}
+}
+
+func TestPromotePendingChange(t *testing.T) {
+	h := testRepo(t)
+	h.converter = &stubConverter{&Conversion{
+		Markdown: []byte("![](media/image1.png)\n"),
+		Assets:   []*Asset{{Name: "media/image1.png", Data: []byte("png")}},
+	}}
+	cover := &Cover{Name: "cover.png", Data: []byte("\x89PNG\r\n\x1a\n")}
+	if _, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Draft", Draft: true, Cover: cover}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Promote("draft", nil); err != nil {
+		t.Fatal("error promoting draft: ", err)
+	}
+	files := headFiles(t, h)
+	sort.Strings(files)
+	if strings.Join(files, " ") != "content/post/draft.md static/img/draft/cover.png static/img/draft/image1.png" {
+		t.Errorf("promoted draft lost its pending files: %v", files)
+	}
+	if len(h.Changes()) != 0 {
+		t.Errorf("expected no pending changes got %d", len(h.Changes()))
+	}
+	p, err := h.GetPost("draft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.frontMatter.Draft {
+		t.Error("promoted post is still a draft")
+	}
+}
+
+func TestPromoteOutsideContentDir(t *testing.T) {
+	h := testRepo(t)
+	b, err := ioutil.ReadFile("testdata/update-post.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a draft outside the content dir can't be promoted
+	if err = ioutil.WriteFile(path.Join(h.path, "outside.md"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.Promote("../../outside", nil); !errors.Is(err, errInvalidPostName) {
+		t.Fatalf("expected invalid name got %v", err)
+	}
+	for _, f := range headFiles(t, h) {
+		if f == "outside.md" {
+			t.Error("promoted a file outside the content dir")
+		}
+	}
+}
+
+func TestInvalidPostNames(t *testing.T) {
+	h := testRepo(t)
+	for _, name := range []string{"../../../x", "..", "a/b", `a\b`, "", ".hidden", "original-title.md"} {
+		if _, err := h.GetPost(name); !errors.Is(err, errInvalidPostName) {
+			t.Errorf("GetPost(%q): expected invalid name got %v", name, err)
+		}
+		if _, err := h.Update(strings.NewReader(""), docxMIME, name, &postDetails{Title: "X"}); !errors.Is(err, errInvalidPostName) {
+			t.Errorf("Update(%q): expected invalid name got %v", name, err)
+		}
+		if _, err := h.Promote(name, nil); !errors.Is(err, errInvalidPostName) {
+			t.Errorf("Promote(%q): expected invalid name got %v", name, err)
+		}
+	}
+	if _, err := h.GetPost("original-title"); err != nil {
+		t.Error("error getting valid post: ", err)
+	}
+}
+
+func TestHugoServerArgs(t *testing.T) {
+	o := &hugoServerOptions{bin: "hugo", port: "1414", environment: "staging", flags: []string{"--navigateToChanged"}}
+	args := strings.Join(o.args("http://localhost"), " ")
+	for _, expected := range []string{"--port 1414", "--environment staging", "--baseURL http://localhost", "--navigateToChanged", "--bind 127.0.0.1"} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("hugo server args %q missing %q", args, expected)
+		}
+	}
+	//the bind address can be overridden
+	o.flags = []string{"--bind=0.0.0.0"}
+	args = strings.Join(o.args("http://localhost"), " ")
+	if strings.Contains(args, "127.0.0.1") || !strings.Contains(args, "--bind=0.0.0.0") {
+		t.Errorf("hugo server args %q didn't use the bind flag", args)
+	}
+}
+
+func TestContentDir(t *testing.T) {
+	h := testRepo(t)
+	h.contentDir = "content/blog"
+	ch, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Elsewhere"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ch.files["content/blog/elsewhere.md"]; !ok {
+		t.Errorf("post not written to content dir: %v", ch.files)
+	}
+	if _, err = h.GetPost("elsewhere"); err != nil {
+		t.Errorf("error reading post from content dir: %s", err)
+	}
+	if url := h.PostURL("elsewhere"); url != "/blog/elsewhere/" {
+		t.Errorf("unexpected post url %s", url)
+	}
+	//updates are written back to the content dir
+	if ch, err = h.Update(strings.NewReader(""), docxMIME, "elsewhere", &postDetails{Title: "Elsewhere", Summary: "updated"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ch.files["content/blog/elsewhere.md"]; !ok || len(ch.files) != 1 {
+		t.Errorf("updated post not written to content dir: %v", ch.files)
+	}
+}
+
+func TestCommitIdentity(t *testing.T) {
+	h := testRepo(t)
+	for _, author := range []*Identity{{Name: "Alice", Email: "alice@example.com"}, nil} {
+		ch, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Post", Summary: fmt.Sprint(author), GitAuthor: author})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = h.Publish(ch.id); err != nil {
+			t.Fatal(err)
+		}
+		ref, err := h.repo.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		commit, err := h.repo.CommitObject(ref.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := &Identity{Name: h.name, Email: h.email}
+		if author != nil {
+			expected = author
+		}
+		if commit.Author.Name != expected.Name || commit.Author.Email != expected.Email {
+			t.Errorf("expected author %v got %s", expected, commit.Author)
+		}
+		if commit.Committer.Name != h.name || commit.Committer.Email != h.email {
+			t.Errorf("expected repo identity as committer got %s", commit.Committer)
+		}
+	}
+}
+
+//pushRemoteChange commits files to the origin of h from
+//another clone as if someone else pushed to it
+func pushRemoteChange(t *testing.T, h *HugoRepo, files map[string]string) {
+	dir := path.Join(path.Dir(h.path), "other")
+	os.RemoveAll(dir)
+	repo, err := git.PlainClone(dir, false, &git.CloneOptions{URL: path.Join(path.Dir(h.path), "origin")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fname, content := range files {
+		if err = os.MkdirAll(path.Dir(path.Join(dir, fname)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path.Join(dir, fname), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = wt.Add(fname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sig := &object.Signature{Name: "other", Email: "other@example.com", When: time.Now()}
+	if _, err = wt.Commit("remote change", &git.CommitOptions{Author: sig}); err != nil {
+		t.Fatal(err)
+	}
+	if err = repo.Push(&git.PushOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//originHead returns the head of the origin of h
+func originHead(t *testing.T, h *HugoRepo) *object.Commit {
+	origin, err := git.PlainOpen(path.Join(path.Dir(h.path), "origin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := origin.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := origin.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commit
+}
+
+func TestDeployRebase(t *testing.T) {
+	h := testRepo(t)
+	//push to the local origin
+	h.test = false
+	ch, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Rebased"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//someone else pushes after the post was staged
+	pushRemoteChange(t, h, map[string]string{"content/post/other.md": "other\n"})
+	remote := originHead(t, h)
+	if _, err = h.Publish(ch.id); err != nil {
+		t.Fatal(err)
+	}
+	head := originHead(t, h)
+	if len(head.ParentHashes) != 1 || head.ParentHashes[0] != remote.Hash {
+		t.Errorf("expected published commit on top of the remote change got parents %v", head.ParentHashes)
+	}
+	if _, err = head.File("content/post/rebased.md"); err != nil {
+		t.Errorf("post not in pushed commit: %s", err)
+	}
+	if _, err = head.File("content/post/other.md"); err != nil {
+		t.Errorf("remote change missing from pushed commit: %s", err)
+	}
+	if ref, err := h.repo.Head(); err != nil || ref.Hash() != head.Hash {
+		t.Errorf("expected local branch at the pushed commit %s got %v %v", head.Hash, ref, err)
+	}
+}
+
+func TestDeployConflict(t *testing.T) {
+	h := testRepo(t)
+	h.test = false
+	ch, err := h.Update(strings.NewReader(""), docxMIME, "original-title", &postDetails{Title: "Original Title", Summary: "ours"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a remote change to another file doesn't conflict
+	pushRemoteChange(t, h, map[string]string{"content/post/other.md": "other\n"})
+	//a remote change to the post does
+	pushRemoteChange(t, h, map[string]string{"content/post/original-title.md": "theirs\n"})
+	remote := originHead(t, h)
+	_, err = h.Publish(ch.id)
+	if !errors.Is(err, errConflict) || !strings.Contains(err.Error(), "content/post/original-title.md") {
+		t.Fatalf("expected conflict on the post file got %v", err)
+	}
+	if head := originHead(t, h); head.Hash != remote.Hash {
+		t.Errorf("conflicting change pushed to origin")
+	}
+	//the change stays pending in the worktree
+	if _, err = h.Change(ch.id); err != nil {
+		t.Errorf("conflicting change no longer pending: %s", err)
+	}
+	p, err := h.GetPost("original-title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.frontMatter.Summary != "ours" {
+		t.Errorf("pending change removed from worktree got summary %q", p.frontMatter.Summary)
+	}
+	wt, err := h.repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, err := wt.Status(); err != nil || st.File("content/post/original-title.md").Staging != git.Unmodified {
+		t.Errorf("conflicting change left staged: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errRebuildTimeout = errors.New("timed out waiting for hugo to rebuild")
+
+//hugoLogLines is the number of lines of hugo output kept
+const hugoLogLines = 200
+
+//errFileRegexp matches the file hugo reports a build error in
+var errFileRegexp = regexp.MustCompile(`"?([^"\s:]+\.(?:md|html))(?::\d+)*"?:`)
+
+//buildFailure is a failed hugo build
+type buildFailure struct {
+	At  time.Time
+	Err string
+	//File is the site file hugo reported the error in
+	File string
+}
+
+//hugoLog follows the output of the hugo server to
+//track when the site has been rebuilt
+type hugoLog struct {
+	mu sync.Mutex
+	//partial line left over from the last write
+	partial []byte
+	//building is set while hugo is building the site
+	building bool
+	//builds counts completed builds
+	builds uint64
+	//err is the error of the last build
+	err error
+	//failure is the most recent failed build
+	failure *buildFailure
+	//rebuilt is closed and replaced when a build completes
+	rebuilt chan struct{}
+	//ring buffer of the latest output lines
+	lines []string
+	next  int
+}
+
+func newHugoLog() *hugoLog {
+	//hugo builds the site when it starts
+	return &hugoLog{building: true, rebuilt: make(chan struct{})}
+}
+
+//starting resets the build state when hugo is started
+func (l *hugoLog) starting() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.building = true
+	l.partial = nil
+}
+
+//Write parses hugo output line by line. It is used
+//as the stdout and stderr of the hugo server
+func (l *hugoLog) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.partial = append(l.partial, b...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(l.partial[:i]))
+		l.keep(line)
+		l.line(line)
+		l.partial = l.partial[i+1:]
+	}
+	return len(b), nil
+}
+
+//keep adds s to the ring buffer of output lines
+func (l *hugoLog) keep(s string) {
+	if len(l.lines) < hugoLogLines {
+		l.lines = append(l.lines, s)
+		return
+	}
+	l.lines[l.next] = s
+	l.next = (l.next + 1) % hugoLogLines
+}
+
+//Lines returns the latest lines of hugo output oldest first
+func (l *hugoLog) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lines := make([]string, 0, len(l.lines))
+	lines = append(lines, l.lines[l.next:]...)
+	return append(lines, l.lines[:l.next]...)
+}
+
+//line updates the build state from a line of hugo output
+func (l *hugoLog) line(s string) {
+	switch {
+	case strings.HasPrefix(s, "Change detected"):
+		l.building = true
+	case strings.HasPrefix(s, "Total in"), strings.HasPrefix(s, "Rebuilt in"), strings.HasPrefix(s, "Built in"):
+		if l.building {
+			l.finish(nil)
+		}
+	case strings.HasPrefix(s, "ERROR"), strings.HasPrefix(s, "Error:"):
+		msg := hugoErrorMessage(s)
+		//the failure reason follows on the next line
+		if msg == "Rebuild failed:" || !l.building {
+			return
+		}
+		log.Println("hugo build failed: ", msg)
+		l.failure = &buildFailure{At: time.Now(), Err: msg}
+		if m := errFileRegexp.FindStringSubmatch(msg); m != nil {
+			l.failure.File = m[1]
+		}
+		l.finish(errors.New(msg))
+	}
+}
+
+//finish records the result of a build and wakes waiters
+func (l *hugoLog) finish(err error) {
+	l.building = false
+	l.builds++
+	l.err = err
+	close(l.rebuilt)
+	l.rebuilt = make(chan struct{})
+}
+
+//hugoErrorMessage strips the level and timestamp
+//from a hugo error log line
+func hugoErrorMessage(s string) string {
+	if strings.HasPrefix(s, "Error:") {
+		return strings.TrimSpace(strings.TrimPrefix(s, "Error:"))
+	}
+	//ERROR 2021/02/20 12:00:00 message
+	fields := strings.SplitN(s, " ", 4)
+	if len(fields) < 4 {
+		return s
+	}
+	return fields[3]
+}
+
+//Builds returns the number of builds hugo has completed
+func (l *hugoLog) Builds() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.builds
+}
+
+//Failure returns the most recent failed build and
+//whether it was the last build
+func (l *hugoLog) Failure() (*buildFailure, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failure == nil {
+		return nil, false
+	}
+	f := *l.failure
+	return &f, l.err != nil
+}
+
+//WaitForBuild waits up to timeout for a build after
+//build n to complete returning the error of the last
+//build or errRebuildTimeout
+func (l *hugoLog) WaitForBuild(n uint64, timeout time.Duration) error {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		l.mu.Lock()
+		builds, err, rebuilt := l.builds, l.err, l.rebuilt
+		l.mu.Unlock()
+		if builds > n {
+			return err
+		}
+		select {
+		case <-rebuilt:
+		case <-t.C:
+			return errRebuildTimeout
+		}
+	}
+}
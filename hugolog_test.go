@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHugoLogBuilds(t *testing.T) {
+	l := newHugoLog()
+	fmt.Fprint(l, "Start building sites … \n\nBuilt in 120 ms\nWatching for changes in /site/{content,static}\n")
+	if n := l.Builds(); n != 1 {
+		t.Fatalf("expected initial build got %d builds", n)
+	}
+	//a wait for a build that has already happened returns at once
+	if err := l.WaitForBuild(0, 0); err != nil {
+		t.Errorf("unexpected error for completed build: %v", err)
+	}
+	if err := l.WaitForBuild(1, time.Millisecond); err != errRebuildTimeout {
+		t.Errorf("expected timeout got %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- l.WaitForBuild(1, time.Second) }()
+	//output can arrive split across writes
+	fmt.Fprint(l, "Change detected, rebuilding site.\n2021-02-20 12:00:00.000 +0000\nSource changed \"/site/content/post/a.md\": WRITE\nTotal ")
+	fmt.Fprint(l, "in 15 ms\n")
+	if err := <-done; err != nil {
+		t.Errorf("unexpected rebuild error: %v", err)
+	}
+
+	fmt.Fprint(l, "Change detected, rebuilding site.\n"+
+		"ERROR 2021/02/20 12:00:01 Rebuild failed:\n"+
+		"ERROR 2021/02/20 12:00:01 \"/site/content/post/a.md:1:1\": unmarshal failed\n"+
+		"Total in 3 ms\n")
+	err := l.WaitForBuild(2, time.Second)
+	if err == nil || err.Error() != `"/site/content/post/a.md:1:1": unmarshal failed` {
+		t.Errorf("expected build error got %v", err)
+	}
+	if n := l.Builds(); n != 3 {
+		t.Errorf("expected 3 builds got %d", n)
+	}
+}
+
+func TestHugoLogFailure(t *testing.T) {
+	l := newHugoLog()
+	if f, _ := l.Failure(); f != nil {
+		t.Errorf("unexpected failure before any builds: %v", f)
+	}
+	fmt.Fprint(l, "Built in 120 ms\n"+
+		"Change detected, rebuilding site.\n"+
+		"ERROR 2021/02/20 12:00:01 Rebuild failed:\n"+
+		"ERROR 2021/02/20 12:00:01 \"/site/content/post/broken.md:3:1\": unmarshal failed\n")
+	f, failing := l.Failure()
+	if f == nil || !failing || f.File != "/site/content/post/broken.md" {
+		t.Fatalf("unexpected failure %+v failing %t", f, failing)
+	}
+	//the failure is kept once a build succeeds
+	fmt.Fprint(l, "Change detected, rebuilding site.\nTotal in 3 ms\n")
+	if f, failing = l.Failure(); f == nil || failing {
+		t.Errorf("unexpected failure %+v failing %t after successful build", f, failing)
+	}
+
+	//only the latest lines are kept
+	for i := 0; i < hugoLogLines+10; i++ {
+		fmt.Fprintf(l, "line %d\n", i)
+	}
+	lines := l.Lines()
+	if len(lines) != hugoLogLines || lines[0] != "line 10" || lines[len(lines)-1] != fmt.Sprintf("line %d", hugoLogLines+9) {
+		t.Errorf("unexpected output lines %q ... %q", lines[0], lines[len(lines)-1])
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//lockFile is the file in the repo's git dir held by the
+//process using the repo's worktree
+const lockFile = "blogposter.lock"
+
+//errRepoLocked is returned when another blogposter
+//process such as the server is using the repo
+var errRepoLocked = errors.New("repo is in use")
+
+//repoLock is a lock on a repo's worktree held by the
+//server or a cli command. Syncing the worktree resets
+//it so only one process may use it at a time
+type repoLock struct {
+	path string
+}
+
+//lockRepo locks the repo at dir for this process. Locks
+//left behind by processes which have exited are taken over
+func lockRepo(dir string) (*repoLock, error) {
+	fpath := path.Join(dir, ".git", lockFile)
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(fpath)
+				return nil, err
+			}
+			return &repoLock{path: fpath}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		b, err := ioutil.ReadFile(fpath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+		if pid > 0 && processRunning(pid) {
+			return nil, fmt.Errorf("%s %w by blogposter process %d. Stop it or use its api at %s", dir, errRepoLocked, pid, apiPrefix)
+		}
+		//stale lock
+		if err = os.Remove(fpath); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%s %w", dir, errRepoLocked)
+}
+
+//processRunning reports whether the process pid exists.
+//Signal 0 only checks the process can be signalled
+func processRunning(pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+//Unlock releases the lock
+func (l *repoLock) Unlock() error {
+	if l == nil {
+		return nil
+	}
+	err := os.Remove(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
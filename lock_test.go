@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRepoLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blogposter-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Mkdir(path.Join(dir, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := lockRepo(dir)
+	if err != nil {
+		t.Fatal("error locking repo: ", err)
+	}
+	if _, err = lockRepo(dir); !errors.Is(err, errRepoLocked) {
+		t.Errorf("expected locking a locked repo to fail got %v", err)
+	}
+	if err = l.Unlock(); err != nil {
+		t.Fatal("error unlocking repo: ", err)
+	}
+
+	//a lock left by a process which exited is taken over
+	stale := path.Join(dir, ".git", lockFile)
+	if err = ioutil.WriteFile(stale, []byte("999999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = lockRepo(dir); err != nil {
+		t.Fatal("error taking over stale lock: ", err)
+	}
+	l.Unlock()
+}
+
+func TestLockHeldAfterHugoFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blogposter-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Mkdir(path.Join(dir, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(&ServerConfig{})
+	if s.lock, err = lockRepo(dir); err != nil {
+		t.Fatal(err)
+	}
+	s.preview = testSupervisor(func(ctx context.Context) (chan error, error) {
+		return nil, errors.New("exec: hugo not found")
+	}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.runPreview(ctx)
+
+	//the cms keeps running without hugo so keeps the lock
+	time.Sleep(20 * time.Millisecond)
+	if _, err = lockRepo(dir); !errors.Is(err, errRepoLocked) {
+		t.Errorf("expected repo to stay locked got %v", err)
+	}
+	cancel()
+	select {
+	case <-s.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("server didn't stop")
+	}
+	l, err := lockRepo(dir)
+	if err != nil {
+		t.Fatal("expected repo to be unlocked on shutdown got ", err)
+	}
+	l.Unlock()
+}
@@ -3,62 +3,42 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 )
 
-const (
-	// environment varialble keys
-	envKeyConfigAuthor           = "BLOGPOSTER_AUTHOR"
-	envKeyConfigPort             = "BLOGPOSTER_PORT"
-	envKeyConfigPath             = "BLOGPOSTER_PATH"
-	envKeyConfigUsername         = "BLOGPOSTER_USERNAME"
-	envKeyConfigToken            = "BLOGPOSTER_USERNAME"
-	envKeyConfigTest             = "BLOGPOSTER_TEST"
-	envKeyConfigName             = "BLOGPOSTER_NAME"
-	envKeyConfigEmail            = "BLOGPOSTER_EMAIL"
-	envKeyConfigBaseURL          = "BLOGPOSTER_BASEURL"
-	envKeyConfigRemoteURL        = "BLOGPOSTER_REMOTEURL"
-	envKeyConfigGAPIPrivateKey   = "GAPI_PRIVATE_KEY"
-	envKeyConfigGAPIPrivateKeyID = "GAPI_PRIVATE_KEY_ID"
-	envKeyConfigGAPIEmail        = "GAPI_EMAIL"
-	envKeyConfigGAPITokenURL     = "GAPI_TOKEN_URL"
-)
-
 func main() {
-	//log to stdout
-	log.SetOutput(os.Stdout)
-
+	configFile := flag.String("config", os.Getenv(envKeyConfigFile), "json or yaml config file. env vars and flags override it")
+	configFlags := newConfigFlags(flag.CommandLine)
 	test := flag.Bool("t", false, "enable test mode (no push)")
 	baseurl := flag.String("BaseURL", "", "hugo server baseurl http://localhost:8080")
 	port := flag.String("p", "", "port for http server")
+	flag.Usage = func() {
+		cliUsage(flag.CommandLine.Output())
+		fmt.Fprintln(flag.CommandLine.Output(), "\nflags:")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	conf := ServerConfig{
-		Author:    os.Getenv(envKeyConfigAuthor),
-		Port:      os.Getenv(envKeyConfigPort),
-		Path:      os.Getenv(envKeyConfigPath),
-		Username:  os.Getenv(envKeyConfigUsername),
-		Token:     os.Getenv(envKeyConfigToken),
-		Name:      os.Getenv(envKeyConfigName),
-		Email:     os.Getenv(envKeyConfigEmail),
-		BaseUrl:   os.Getenv(envKeyConfigAuthor),
-		RemoteUrl: os.Getenv(envKeyConfigBaseURL),
-		GAPI: &GAPIConfig{
-			PrivateKeyID: os.Getenv(envKeyConfigGAPIPrivateKeyID),
-			PrivateKey:   os.Getenv(envKeyConfigGAPIPrivateKey),
-			Email:        os.Getenv(envKeyConfigGAPIEmail),
-			TokenURL:     os.Getenv(envKeyConfigGAPITokenURL),
-		},
+	//subcommands log to stderr so their output can be
+	//piped. The server logs to stdout
+	if flag.NArg() > 0 {
+		log.SetOutput(os.Stderr)
+	} else {
+		log.SetOutput(os.Stdout)
 	}
-	if test, ok := os.LookupEnv(envKeyConfigTest); ok {
-		if test != "0" {
-			conf.Test = true
-		}
+
+	conf, err := LoadConfig(*configFile, os.LookupEnv)
+	if err != nil {
+		log.Fatal("config: ", err)
 	}
 	//override conf with set cmdline flag values
+	if err = configFlags.apply(conf); err != nil {
+		log.Fatal("config: ", err)
+	}
 	if *test {
 		conf.Test = *test
 	}
@@ -69,13 +49,18 @@ func main() {
 		conf.Port = *port
 	}
 
-	server := NewServer(&conf)
-	server.PostPush = func() error {
-		return nil
+	//run subcommands without the web server
+	if flag.NArg() > 0 {
+		if err := runCLI(context.Background(), conf, flag.Args(), os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "blogposter:", err)
+			os.Exit(1)
+		}
+		return
 	}
+
+	server := NewServer(conf)
 	ctx, cancel := context.WithCancel(context.Background())
-	c, err := server.Start(ctx)
-	if err != nil {
+	if err := server.Start(ctx); err != nil {
 		log.Fatal("start: ", err)
 	}
 
@@ -84,12 +69,8 @@ func main() {
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	log.Println("waiting")
 
-	select {
-	case <-sig:
-		log.Println("received SIGINT. Shutting down...")
-		cancel()
-		<-server.stopped
-	case err := <-c:
-		log.Fatal("hugo server stopped unexpectedly: ", err)
-	}
+	<-sig
+	log.Println("received SIGINT. Shutting down...")
+	cancel()
+	<-server.stopped
 }
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+//post push action types
+const (
+	//actionCommand runs a command with the post in env vars
+	actionCommand = "command"
+	//actionWebhook posts the post as json to a url
+	actionWebhook = "webhook"
+	//actionPurge sends PURGE requests for the post's
+	//pages to a caching proxy or cdn
+	actionPurge = "purge"
+)
+
+//defaultActionTimeout is the timeout of each attempt
+//of an action without a timeout set
+const defaultActionTimeout = 30 * time.Second
+
+//postPushRetryWait is the wait before retrying a failed
+//action. It grows with each attempt
+var postPushRetryWait = time.Second
+
+//PostPushAction is run after a post is pushed
+type PostPushAction struct {
+	//Name shown in results. Defaults to the type
+	Name string `json:"name"`
+	//Type is command, webhook or purge
+	Type string `json:"type"`
+	//Command and args to run for command actions
+	Command []string `json:"command"`
+	//URL the post is posted to for webhooks or the
+	//base url of the cache to purge
+	URL string `json:"url"`
+	//Timeout of each attempt e.g. 30s
+	Timeout string `json:"timeout"`
+	//Retries after a failed attempt
+	Retries int `json:"retries"`
+}
+
+//pushEvent describes a published post
+type pushEvent struct {
+	Post    string `json:"post"`
+	Message string `json:"message"`
+	//Path is the site url path of the post
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+}
+
+//env returns the event as environment variables
+func (ev *pushEvent) env() []string {
+	return []string{
+		"BLOGPOSTER_POST=" + ev.Post,
+		"BLOGPOSTER_MESSAGE=" + ev.Message,
+		"BLOGPOSTER_POST_PATH=" + ev.Path,
+		"BLOGPOSTER_TIME=" + ev.Time.Format(time.RFC3339),
+	}
+}
+
+//actionResult is the outcome of a post push action
+type actionResult struct {
+	Name     string `json:"name"`
+	Attempts int    `json:"attempts"`
+	Output   string `json:"output"`
+	Err      string `json:"error,omitempty"`
+}
+
+//Validate checks the action is complete
+func (a *PostPushAction) Validate() error {
+	switch a.Type {
+	case actionCommand:
+		if len(a.Command) == 0 {
+			return errors.New("command action has no command")
+		}
+	case actionWebhook, actionPurge:
+		if len(a.URL) == 0 {
+			return fmt.Errorf("%s action has no url", a.Type)
+		}
+	default:
+		return fmt.Errorf("unknown post push action type: %s", a.Type)
+	}
+	if len(a.Timeout) > 0 {
+		if _, err := time.ParseDuration(a.Timeout); err != nil {
+			return errors.New("timeout: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (a *PostPushAction) name() string {
+	if len(a.Name) > 0 {
+		return a.Name
+	}
+	return a.Type
+}
+
+func (a *PostPushAction) timeout() time.Duration {
+	if d, err := time.ParseDuration(a.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultActionTimeout
+}
+
+//Run runs the action for ev retrying it on failure
+func (a *PostPushAction) Run(ev *pushEvent) *actionResult {
+	res := &actionResult{Name: a.name()}
+	for {
+		res.Attempts++
+		ctx, cancel := context.WithTimeout(context.Background(), a.timeout())
+		out, err := a.run(ctx, ev)
+		cancel()
+		res.Output = out
+		if err == nil {
+			res.Err = ""
+			return res
+		}
+		res.Err = err.Error()
+		log.Printf("post push action %s attempt %d failed: %s\n", res.Name, res.Attempts, err)
+		if res.Attempts > a.Retries {
+			return res
+		}
+		time.Sleep(postPushRetryWait * time.Duration(res.Attempts))
+	}
+}
+
+//run makes a single attempt at the action
+func (a *PostPushAction) run(ctx context.Context, ev *pushEvent) (string, error) {
+	switch a.Type {
+	case actionCommand:
+		cmd := exec.CommandContext(ctx, a.Command[0], a.Command[1:]...)
+		cmd.Env = append(os.Environ(), ev.env()...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	case actionWebhook:
+		b, err := json.Marshal(ev)
+		if err != nil {
+			return "", err
+		}
+		req, err := http.NewRequest(http.MethodPost, a.URL, bytes.NewReader(b))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return doActionRequest(ctx, req)
+	case actionPurge:
+		//the post and the pages listing it
+		var out []string
+		for _, p := range []string{ev.Path, "/"} {
+			req, err := http.NewRequest("PURGE", strings.TrimSuffix(a.URL, "/")+p, nil)
+			if err != nil {
+				return "", err
+			}
+			res, err := doActionRequest(ctx, req)
+			out = append(out, res)
+			if err != nil {
+				return strings.Join(out, "\n"), err
+			}
+		}
+		return strings.Join(out, "\n"), nil
+	}
+	return "", fmt.Errorf("unknown post push action type: %s", a.Type)
+}
+
+//doActionRequest sends req returning the response
+//status and body. Non 2xx responses are errors
+func doActionRequest(ctx context.Context, req *http.Request) (string, error) {
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	out := fmt.Sprintf("%s %s: %s %s", req.Method, req.URL, res.Status, b)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return out, errors.New("unexpected response status " + res.Status)
+	}
+	return out, nil
+}
+
+//runPostPush runs actions in order for ev
+func runPostPush(actions []*PostPushAction, ev *pushEvent) []*actionResult {
+	results := make([]*actionResult, len(actions))
+	for i, a := range actions {
+		results[i] = a.Run(ev)
+	}
+	return results
+}
+
+//postPushWait is how long publishing waits to show the
+//post push action results before leaving them running
+var postPushWait = 10 * time.Second
+
+//maxPushRuns is how many post push runs are kept
+//to show on the status page
+const maxPushRuns = 20
+
+//pushRun is a run of the post push actions of a
+//published post in the background
+type pushRun struct {
+	Post    string
+	Started time.Time
+	//done is closed once results are set
+	done    chan struct{}
+	results []*actionResult
+}
+
+//Done reports whether the actions have finished
+func (r *pushRun) Done() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//Results returns the action results or nil
+//if the actions are still running
+func (r *pushRun) Results() []*actionResult {
+	if !r.Done() {
+		return nil
+	}
+	return r.results
+}
+
+//Wait waits for the actions to finish returning their results
+func (r *pushRun) Wait() []*actionResult {
+	<-r.done
+	return r.results
+}
+
+//WaitFor waits up to timeout for the actions to finish
+//returning their results. ok is false if they're still running
+func (r *pushRun) WaitFor(timeout time.Duration) (results []*actionResult, ok bool) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-r.done:
+		return r.results, true
+	case <-t.C:
+		return nil, false
+	}
+}
+
+//pushRuns are the most recent post push runs
+type pushRuns struct {
+	mu   sync.Mutex
+	runs []*pushRun
+}
+
+//start runs the post push actions of post with run
+//in the background. Failed actions are logged
+func (p *pushRuns) start(post string, run func() []*actionResult) *pushRun {
+	r := &pushRun{Post: post, Started: time.Now(), done: make(chan struct{})}
+	p.mu.Lock()
+	p.runs = append(p.runs, r)
+	if len(p.runs) > maxPushRuns {
+		p.runs = p.runs[len(p.runs)-maxPushRuns:]
+	}
+	p.mu.Unlock()
+	go func() {
+		r.results = run()
+		for _, res := range r.results {
+			if len(res.Err) > 0 {
+				log.Printf("post push action %s failed for %s: %s\n", res.Name, post, res.Err)
+			}
+		}
+		close(r.done)
+	}()
+	return r
+}
+
+//Recent returns the post push runs newest first
+func (p *pushRuns) Recent() []*pushRun {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	runs := make([]*pushRun, len(p.runs))
+	for i, r := range p.runs {
+		runs[len(runs)-1-i] = r
+	}
+	return runs
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostPushActions(t *testing.T) {
+	postPushRetryWait = 0
+	var hooks []*pushEvent
+	var purged []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "PURGE":
+			purged = append(purged, req.URL.Path)
+		case http.MethodPost:
+			ev := new(pushEvent)
+			if err := json.NewDecoder(req.Body).Decode(ev); err != nil {
+				t.Error("error decoding webhook payload: ", err)
+			}
+			hooks = append(hooks, ev)
+			//fail the first attempt
+			if len(hooks) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	ev := &pushEvent{Post: "my-post", Message: "published my-post", Path: "/post/my-post/", Time: time.Now()}
+	results := runPostPush([]*PostPushAction{
+		{Type: actionCommand, Command: []string{"sh", "-c", "echo $BLOGPOSTER_POST $BLOGPOSTER_POST_PATH"}},
+		{Name: "notify", Type: actionWebhook, URL: srv.URL + "/hook", Retries: 1},
+		{Type: actionPurge, URL: srv.URL + "/"},
+		{Type: actionCommand, Command: []string{"false"}, Retries: 2},
+	}, ev)
+
+	if res := results[0]; len(res.Err) > 0 || res.Output != "my-post /post/my-post/\n" {
+		t.Errorf("unexpected command result %+v", res)
+	}
+	if res := results[1]; res.Name != "notify" || res.Attempts != 2 || len(res.Err) > 0 {
+		t.Errorf("unexpected webhook result %+v", res)
+	}
+	if len(hooks) != 2 || hooks[1].Post != "my-post" || hooks[1].Message != ev.Message {
+		t.Errorf("unexpected webhook payloads %v", hooks)
+	}
+	if res := results[2]; len(res.Err) > 0 || len(purged) != 2 || purged[0] != "/post/my-post/" || purged[1] != "/" {
+		t.Errorf("unexpected purge result %+v purged %v", res, purged)
+	}
+	if res := results[3]; res.Attempts != 3 || len(res.Err) == 0 {
+		t.Errorf("expected failing command to be retried got %+v", res)
+	}
+}
+
+func TestPostPushActionTimeout(t *testing.T) {
+	a := &PostPushAction{Type: actionCommand, Command: []string{"sleep", "5"}, Timeout: "10ms"}
+	start := time.Now()
+	if res := a.Run(new(pushEvent)); len(res.Err) == 0 {
+		t.Error("expected timed out command to fail")
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Error("command was not killed at timeout")
+	}
+}
+
+func TestPostPushActionValidate(t *testing.T) {
+	for _, a := range []*PostPushAction{
+		{Type: "email"},
+		{Type: actionCommand},
+		{Type: actionWebhook},
+		{Type: actionPurge, URL: "http://cache", Timeout: "soon"},
+	} {
+		if err := a.Validate(); err == nil {
+			t.Errorf("expected error validating %+v", a)
+		}
+	}
+}
+
+func TestPublishResults(t *testing.T) {
+	s, handler := testServer(t)
+	s.config.Test = false
+	s.config.PostPush = []*PostPushAction{
+		{Name: "deploy", Type: actionCommand, Command: []string{"sh", "-c", "echo deployed $BLOGPOSTER_POST"}},
+	}
+	ch, err := s.hugo.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Hooked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, postRequest("/publish", url.Values{"change": {ch.id}}))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "successfully published hooked") {
+		t.Fatalf("unexpected publish response %d: %s", w.Code, body)
+	}
+	if !strings.Contains(body, "<td>deploy</td>") || !strings.Contains(body, "deployed hooked") || strings.Contains(body, "still running") {
+		t.Errorf("publish page missing action results: %s", body)
+	}
+
+	//and on the status page
+	runs := s.pushes.Recent()
+	if len(runs) != 1 || runs[0].Post != "hooked" || !runs[0].Done() {
+		t.Fatalf("unexpected post push runs %v", runs)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	body = w.Body.String()
+	if !strings.Contains(body, "<td>deploy</td>") || !strings.Contains(body, "deployed hooked") {
+		t.Errorf("status page missing action results: %s", body)
+	}
+}
+
+func TestAPIPublishResults(t *testing.T) {
+	s, handler := testServer(t)
+	s.config.Test = false
+	s.config.PostPush = []*PostPushAction{
+		{Name: "deploy", Type: actionCommand, Command: []string{"sh", "-c", "echo deployed $BLOGPOSTER_POST"}},
+	}
+	ch, err := s.hugo.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Hooked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := apiRequest(t, handler, http.MethodPost, "/api/v1/changes/"+ch.id+"/publish", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("publish returned %d: %s", w.Code, w.Body)
+	}
+	res := new(apiPublishResponse)
+	decodeAPIResponse(t, w, res)
+	if res.PostPush || len(res.Results) != 1 || res.Results[0].Name != "deploy" || !strings.Contains(res.Results[0].Output, "deployed hooked") {
+		t.Errorf("unexpected publish response %+v", res)
+	}
+}
+
+func TestPublishDoesntWaitForActions(t *testing.T) {
+	s, handler := testServer(t)
+	s.config.Test = false
+	s.config.PostPush = []*PostPushAction{{Type: actionCommand, Command: []string{"sleep", "5"}}}
+	release := make(chan struct{})
+	s.PostPush = func(ev *pushEvent) []*actionResult {
+		<-release
+		return nil
+	}
+	defer close(release)
+	defer func(wait time.Duration) { postPushWait = wait }(postPushWait)
+	postPushWait = 10 * time.Millisecond
+	ch, err := s.hugo.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Slow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, postRequest("/publish", url.Values{"change": {ch.id}}))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `Post push actions are still running. Their results are shown on the <a href="/status">status page</a>`) {
+		t.Fatalf("unexpected publish response %d: %s", w.Code, w.Body)
+	}
+	if runs := s.pushes.Recent(); len(runs) != 1 || runs[0].Done() {
+		t.Errorf("expected actions to still be running got %v", runs)
+	}
+}
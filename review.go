@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+//forges pull requests can be opened on
+const (
+	forgeGitHub = "github"
+	forgeGitea  = "gitea"
+)
+
+//defaultGitHubAPI is the api of github.com
+const defaultGitHubAPI = "https://api.github.com"
+
+//defaultBranchPrefix prefixes the branches of pull requests
+const defaultBranchPrefix = "blogposter/"
+
+//forgeClient is the http client of forge api requests
+var forgeClient = &http.Client{Timeout: 30 * time.Second}
+
+//ReviewConfig publishes changes by pushing them to a
+//branch named after the post and opening a pull request
+//instead of pushing to the checked out branch. The site
+//isn't built and post push actions aren't run as the
+//change isn't live until the pull request is merged
+type ReviewConfig struct {
+	//Forge hosting the repo: github or gitea
+	Forge string `json:"forge"`
+	//URL of the forge. Defaults to https://api.github.com for
+	//github. Required for gitea e.g. https://gitea.example.com
+	URL string `json:"url"`
+	//Repo the pull requests are opened on as owner/name
+	Repo string `json:"repo"`
+	//Token for the forge api. Defaults to the token of the
+	//git auth which may be read from its token file
+	Token string `json:"token"`
+	//TokenFile the token is read from e.g. a docker secret
+	TokenFile string `json:"tokenfile"`
+	//Base branch pull requests merge into.
+	//Defaults to the checked out branch
+	Base string `json:"base"`
+	//BranchPrefix of pull request branches. Defaults to blogposter/
+	BranchPrefix string `json:"branchprefix"`
+}
+
+//Validate checks the review config is complete
+func (r *ReviewConfig) Validate() error {
+	switch r.Forge {
+	case forgeGitHub:
+	case forgeGitea:
+		if len(r.URL) == 0 {
+			return errors.New("gitea review has no url")
+		}
+	default:
+		return fmt.Errorf("unknown forge: %s", r.Forge)
+	}
+	if parts := strings.Split(r.Repo, "/"); len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return fmt.Errorf("repo %q is not owner/name", r.Repo)
+	}
+	return nil
+}
+
+//branch returns the pull request branch of post name
+func (r *ReviewConfig) branch(name string) string {
+	prefix := r.BranchPrefix
+	if len(prefix) == 0 {
+		prefix = defaultBranchPrefix
+	}
+	return prefix + name
+}
+
+//pullRequest is a pull request to open
+type pullRequest struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	//Head is the branch with the change
+	Head string `json:"head"`
+	//Base is the branch the change merges into
+	Base string `json:"base"`
+}
+
+//forge opens pull requests on a git host
+type forge interface {
+	//OpenPullRequest opens pr returning its url. If the head
+	//branch already has an open pull request its url is
+	//returned as the push updated it
+	OpenPullRequest(ctx context.Context, pr *pullRequest) (string, error)
+}
+
+//newForge returns the forge of r authenticating with token
+//if r doesn't have its own
+func newForge(r *ReviewConfig, token string) (forge, error) {
+	switch {
+	case len(r.Token) > 0:
+		token = r.Token
+	case len(r.TokenFile) > 0:
+		b, err := ioutil.ReadFile(r.TokenFile)
+		if err != nil {
+			return nil, errors.New("read review token file: " + err.Error())
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	api := &forgeAPI{repo: r.Repo, token: token}
+	switch r.Forge {
+	case forgeGitHub:
+		api.url = r.URL
+		if len(api.url) == 0 {
+			api.url = defaultGitHubAPI
+		}
+		return &githubForge{api}, nil
+	case forgeGitea:
+		api.url = strings.TrimSuffix(r.URL, "/") + "/api/v1"
+		return &giteaForge{api}, nil
+	}
+	return nil, fmt.Errorf("unknown forge: %s", r.Forge)
+}
+
+//gitToken returns the token http git auth authenticates
+//with, which tokenfile auth reads from its file, or token
+//if auth doesn't have one
+func gitToken(auth transport.AuthMethod, token string) string {
+	if basic, ok := auth.(*githttp.BasicAuth); ok && len(basic.Password) > 0 {
+		return basic.Password
+	}
+	return token
+}
+
+//forgeAPI makes requests to the rest api of a forge
+type forgeAPI struct {
+	url   string
+	repo  string
+	token string
+}
+
+//do sends a request to the repo's api path with body as json
+//decoding the response into out. It returns the response
+//status and an error for responses other than 2xx
+func (f *forgeAPI) do(ctx context.Context, method, path string, body, out interface{}) (int, error) {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+	u := strings.TrimSuffix(f.url, "/") + "/repos/" + f.repo + path
+	req, err := http.NewRequest(method, u, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	if len(f.token) > 0 {
+		req.Header.Set("Authorization", "token "+f.token)
+	}
+	res, err := forgeClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	rb, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("%s %s: %s %s", method, u, res.Status, bytes.TrimSpace(rb))
+	}
+	if out != nil {
+		if err = json.Unmarshal(rb, out); err != nil {
+			return res.StatusCode, fmt.Errorf("%s %s: %s", method, u, err)
+		}
+	}
+	return res.StatusCode, nil
+}
+
+//forgePull is a pull request returned by a forge api
+type forgePull struct {
+	URL  string `json:"html_url"`
+	Head struct {
+		Ref string `json:"ref"`
+	} `json:"head"`
+	Base struct {
+		Ref string `json:"ref"`
+	} `json:"base"`
+}
+
+//githubForge opens pull requests on github
+type githubForge struct {
+	*forgeAPI
+}
+
+func (g *githubForge) OpenPullRequest(ctx context.Context, pr *pullRequest) (string, error) {
+	created := new(forgePull)
+	status, err := g.do(ctx, http.MethodPost, "/pulls", pr, created)
+	if status != http.StatusUnprocessableEntity {
+		return created.URL, err
+	}
+	//github rejects a second pull request for a branch
+	owner := strings.Split(g.repo, "/")[0]
+	q := url.Values{"state": {"open"}, "head": {owner + ":" + pr.Head}, "base": {pr.Base}}
+	var open []*forgePull
+	if _, lerr := g.do(ctx, http.MethodGet, "/pulls?"+q.Encode(), nil, &open); lerr != nil || len(open) == 0 {
+		return "", err
+	}
+	return open[0].URL, nil
+}
+
+//giteaForge opens pull requests on gitea
+type giteaForge struct {
+	*forgeAPI
+}
+
+func (g *giteaForge) OpenPullRequest(ctx context.Context, pr *pullRequest) (string, error) {
+	created := new(forgePull)
+	status, err := g.do(ctx, http.MethodPost, "/pulls", pr, created)
+	if status != http.StatusConflict {
+		return created.URL, err
+	}
+	//gitea rejects a second pull request for a branch
+	var open []*forgePull
+	if _, lerr := g.do(ctx, http.MethodGet, "/pulls?state=open", nil, &open); lerr != nil {
+		return "", err
+	}
+	for _, p := range open {
+		if p.Head.Ref == pr.Head && p.Base.Ref == pr.Base {
+			return p.URL, nil
+		}
+	}
+	return "", err
+}
+
+//openPullRequest pushes the commit at HEAD to the pull request
+//branch of change c and opens a pull request for it. The
+//caller resets the checked out branch to its parent
+func (h *HugoRepo) openPullRequest(c *change) (string, error) {
+	head, err := h.repo.Head()
+	if err != nil {
+		return "", err
+	}
+	base := h.review.Base
+	if len(base) == 0 {
+		base = head.Name().Short()
+	}
+	branch := h.review.branch(c.name)
+	ref := plumbing.NewBranchReferenceName(branch)
+	if err = h.repo.Storer.SetReference(plumbing.NewHashReference(ref, head.Hash())); err != nil {
+		return "", err
+	}
+	defer h.repo.Storer.RemoveReference(ref)
+	//force push so publishing the post again updates its pull request
+	err = h.repo.PushContext(context.TODO(), &git.PushOptions{
+		RefSpecs: []config.RefSpec{config.RefSpec("+" + ref + ":" + ref)},
+		Auth:     h.auth,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", errors.New("push " + branch + ": " + err.Error())
+	}
+	body := "Published with blogposter"
+	if c.author != nil {
+		body += " by " + c.author.Name
+	}
+	return h.forge.OpenPullRequest(context.TODO(), &pullRequest{
+		Title: c.msg,
+		Body:  body,
+		Head:  branch,
+		Base:  base,
+	})
+}
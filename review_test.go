@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+//stubForge serves the pull request api of a forge. Pull
+//requests for a head branch which already has one are
+//rejected with the conflict status
+type stubForge struct {
+	conflict int
+	opened   []*pullRequest
+	token    string
+}
+
+func (f *stubForge) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.token = req.Header.Get("Authorization")
+	if !strings.HasSuffix(req.URL.Path, "/repos/owner/blog/pulls") {
+		http.NotFound(w, req)
+		return
+	}
+	pull := func(pr *pullRequest) map[string]interface{} {
+		return map[string]interface{}{
+			"html_url": "https://forge.example.com/owner/blog/pull/" + pr.Head,
+			"head":     map[string]string{"ref": pr.Head},
+			"base":     map[string]string{"ref": pr.Base},
+		}
+	}
+	if req.Method == http.MethodGet {
+		head := req.URL.Query().Get("head")
+		open := []map[string]interface{}{}
+		for _, pr := range f.opened {
+			if len(head) == 0 || head == "owner:"+pr.Head {
+				open = append(open, pull(pr))
+			}
+		}
+		json.NewEncoder(w).Encode(open)
+		return
+	}
+	pr := new(pullRequest)
+	if err := json.NewDecoder(req.Body).Decode(pr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, open := range f.opened {
+		if open.Head == pr.Head {
+			http.Error(w, "pull request already exists", f.conflict)
+			return
+		}
+	}
+	f.opened = append(f.opened, pr)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pull(pr))
+}
+
+func TestOpenPullRequest(t *testing.T) {
+	for _, review := range []*ReviewConfig{
+		{Forge: forgeGitHub, Repo: "owner/blog"},
+		{Forge: forgeGitea, Repo: "owner/blog", Token: "gitea-token"},
+	} {
+		stub := &stubForge{conflict: http.StatusUnprocessableEntity}
+		if review.Forge == forgeGitea {
+			stub.conflict = http.StatusConflict
+		}
+		srv := httptest.NewServer(stub)
+		review.URL = srv.URL
+		f, err := newForge(review, "config-token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pr := &pullRequest{Title: "published post", Head: "blogposter/post", Base: "master"}
+		expected := "https://forge.example.com/owner/blog/pull/blogposter/post"
+		if u, err := f.OpenPullRequest(context.Background(), pr); err != nil || u != expected {
+			t.Errorf("%s: expected pull request %s got %q %v", review.Forge, expected, u, err)
+		}
+		//opening it again returns the existing pull request
+		if u, err := f.OpenPullRequest(context.Background(), pr); err != nil || u != expected {
+			t.Errorf("%s: expected existing pull request %s got %q %v", review.Forge, expected, u, err)
+		}
+		if len(stub.opened) != 1 {
+			t.Errorf("%s: expected 1 pull request got %d", review.Forge, len(stub.opened))
+		}
+		token := "token config-token"
+		if len(review.Token) > 0 {
+			token = "token " + review.Token
+		}
+		if stub.token != token {
+			t.Errorf("%s: expected authorization %q got %q", review.Forge, token, stub.token)
+		}
+		srv.Close()
+	}
+}
+
+func TestForgeToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blogposter-review")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gitTokenFile := path.Join(dir, "git-token")
+	reviewTokenFile := path.Join(dir, "review-token")
+	for fname, token := range map[string]string{gitTokenFile: "git-file-token\n", reviewTokenFile: "review-file-token\n"} {
+		if err = ioutil.WriteFile(fname, []byte(token), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := &ServerConfig{GitAuth: &GitAuth{Method: gitAuthTokenFile, TokenFile: gitTokenFile}}
+	auth, err := conf.AuthMethod()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the token of tokenfile git auth is used without a review token
+	if token := gitToken(auth, conf.Token); token != "git-file-token" {
+		t.Errorf("expected the git auth's token got %q", token)
+	}
+	if token := gitToken(nil, "config-token"); token != "config-token" {
+		t.Errorf("expected the config's token without git auth got %q", token)
+	}
+
+	review := &ReviewConfig{Forge: forgeGitHub, Repo: "owner/blog", TokenFile: reviewTokenFile}
+	f, err := newForge(review, "git-file-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := f.(*githubForge).token; token != "review-file-token" {
+		t.Errorf("expected the review token file's token got %q", token)
+	}
+	review.TokenFile = path.Join(dir, "missing")
+	if _, err = newForge(review, ""); err == nil {
+		t.Error("expected missing review token file to fail")
+	}
+}
+
+func TestReviewPublish(t *testing.T) {
+	h := testRepo(t)
+	stub := &stubForge{conflict: http.StatusUnprocessableEntity}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	h.review = &ReviewConfig{Forge: forgeGitHub, URL: srv.URL, Repo: "owner/blog"}
+	forge, err := newForge(h.review, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.forge = forge
+	//push to the local origin
+	h.test = false
+
+	base, err := h.repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := h.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Reviewed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := h.Publish(ch.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr != "https://forge.example.com/owner/blog/pull/blogposter/reviewed" {
+		t.Errorf("unexpected pull request url %q", pr)
+	}
+	if len(stub.opened) != 1 || stub.opened[0].Base != "master" || stub.opened[0].Title != ch.msg {
+		t.Errorf("unexpected pull requests %+v", stub.opened)
+	}
+
+	//the change is only on the pull request branch
+	if head, err := h.repo.Head(); err != nil || head.Hash() != base.Hash() {
+		t.Errorf("expected checked out branch to stay at %s got %v %v", base.Hash(), head, err)
+	}
+	if _, err = h.GetPost("reviewed"); err == nil {
+		t.Error("reviewed post left in worktree")
+	}
+	if len(h.Changes()) != 0 {
+		t.Errorf("expected no pending changes got %d", len(h.Changes()))
+	}
+	origin, err := git.PlainOpen(path.Join(path.Dir(h.path), "origin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref, err := origin.Reference(plumbing.NewBranchReferenceName("master"), true); err != nil || ref.Hash() != base.Hash() {
+		t.Errorf("expected origin master to stay at %s got %v %v", base.Hash(), ref, err)
+	}
+	ref, err := origin.Reference(plumbing.NewBranchReferenceName("blogposter/reviewed"), true)
+	if err != nil {
+		t.Fatal("pull request branch not pushed: ", err)
+	}
+	commit, err := origin.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = commit.File("content/post/reviewed.md"); err != nil {
+		t.Errorf("post not in pull request commit: %s", err)
+	}
+	if _, err = h.repo.Reference(plumbing.NewBranchReferenceName("blogposter/reviewed"), true); err == nil {
+		t.Error("pull request branch left in local repo")
+	}
+}
+
+func TestReviewConfigValidate(t *testing.T) {
+	valid := []*ReviewConfig{
+		{Forge: forgeGitHub, Repo: "owner/blog"},
+		{Forge: forgeGitea, URL: "https://gitea.example.com", Repo: "owner/blog"},
+	}
+	for _, r := range valid {
+		if err := r.Validate(); err != nil {
+			t.Errorf("expected %+v to be valid got %s", r, err)
+		}
+	}
+	invalid := []*ReviewConfig{
+		{Forge: "gitlab", Repo: "owner/blog"},
+		{Forge: forgeGitea, Repo: "owner/blog"},
+		{Forge: forgeGitHub, Repo: "blog"},
+		{Forge: forgeGitHub, Repo: "owner/"},
+	}
+	for _, r := range invalid {
+		if err := r.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", r)
+		}
+	}
+	if b := (&ReviewConfig{BranchPrefix: "review-"}).branch("post"); b != "review-post" {
+		t.Errorf("unexpected branch %s", b)
+	}
+}
+
+func TestReviewPublishPage(t *testing.T) {
+	s, handler := testServer(t)
+	srv := httptest.NewServer(&stubForge{conflict: http.StatusUnprocessableEntity})
+	defer srv.Close()
+	s.config.Review = &ReviewConfig{Forge: forgeGitHub, URL: srv.URL, Repo: "owner/blog"}
+	s.hugo.review = s.config.Review
+	forge, err := newForge(s.config.Review, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.hugo.forge = forge
+	s.hugo.test = false
+
+	ch, err := s.hugo.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Reviewed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, postRequest("/publish", url.Values{"change": {ch.id}}))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || strings.Contains(body, "successfully published") {
+		t.Fatalf("review publish reported as published %d: %s", w.Code, body)
+	}
+	if !strings.Contains(body, "opened a review pull request for reviewed") || !strings.Contains(body, `href="https://forge.example.com/owner/blog/pull/blogposter/reviewed"`) {
+		t.Errorf("publish page missing pull request: %s", body)
+	}
+}
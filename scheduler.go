@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+//errNotScheduled is returned for a scheduled
+//post id which isn't queued
+var errNotScheduled = errors.New("no scheduled post")
+
+//errPublishing is returned when cancelling a scheduled
+//post which is being published
+var errPublishing = errors.New("is being published")
+
+//scheduledPost is a staged change waiting to be
+//published at a future time
+type scheduledPost struct {
+	ID   string    `json:"id"`
+	Name string    `json:"name"`
+	Msg  string    `json:"msg"`
+	At   time.Time `json:"at"`
+	//files to commit keyed by repo path
+	Files map[string][]byte `json:"files"`
+	//git author of the post. nil is the repo's identity
+	Author *Identity `json:"author,omitempty"`
+	//Base is the hash of the commit the post was changed on
+	Base string `json:"base,omitempty"`
+	//Failed is the error which stopped the post from
+	//publishing. Failed posts stay queued until they're
+	//cancelled but aren't retried
+	Failed string `json:"failed,omitempty"`
+}
+
+//scheduler publishes queued posts when their time
+//arrives. The queue is persisted to a json file so
+//it survives restarts
+type scheduler struct {
+	mu sync.Mutex
+	//running serializes publishDue so posts aren't published
+	//twice. mu isn't held while publishing as it uses the network
+	running sync.Mutex
+	path    string
+	queue   []*scheduledPost
+	//publishing is the post being published. It can't be cancelled
+	publishing *scheduledPost
+	publish    func(*scheduledPost) error
+}
+
+//newScheduler returns a scheduler loading any
+//queue persisted at path
+func newScheduler(path string, publish func(*scheduledPost) error) (*scheduler, error) {
+	s := &scheduler{path: path, publish: publish}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &s.queue); err != nil {
+		return nil, err
+	}
+	//queues saved before posts had ids
+	for _, p := range s.queue {
+		if len(p.ID) == 0 {
+			p.ID = newChangeID()
+		}
+	}
+	log.Printf("loaded %d scheduled posts from %s\n", len(s.queue), path)
+	return s, nil
+}
+
+//Add queues p to be published
+func (s *scheduler) Add(p *scheduledPost) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(p.ID) == 0 {
+		p.ID = newChangeID()
+	}
+	s.queue = append(s.queue, p)
+	sort.Slice(s.queue, func(i, j int) bool {
+		return s.queue[i].At.Before(s.queue[j].At)
+	})
+	return s.save()
+}
+
+//Queue returns copies of the queued posts in publish order
+func (s *scheduler) Queue() []*scheduledPost {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := make([]*scheduledPost, len(s.queue))
+	for i, p := range s.queue {
+		cp := *p
+		q[i] = &cp
+	}
+	return q
+}
+
+//Cancel removes the post id from the queue returning it
+func (s *scheduler) Cancel(id string) (*scheduledPost, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range s.queue {
+		if p.ID == id {
+			if p == s.publishing {
+				return nil, fmt.Errorf("scheduled post %s %w", p.Name, errPublishing)
+			}
+			s.queue = append(s.queue[:i:i], s.queue[i+1:]...)
+			return p, s.save()
+		}
+	}
+	return nil, fmt.Errorf("%w %s", errNotScheduled, id)
+}
+
+//Run publishes due posts every interval until ctx is done
+func (s *scheduler) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		s.publishDue(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+//publishDue publishes all posts due at now returning
+//how many were published and failed. Posts which fail
+//to publish stay queued and are retried next run unless
+//retrying can't succeed such as when they conflict with
+//remote changes. Those are marked failed instead
+func (s *scheduler) publishDue(now time.Time) (published, failed int) {
+	s.running.Lock()
+	defer s.running.Unlock()
+	done := make(map[*scheduledPost]bool)
+	stuck := make(map[*scheduledPost]error)
+	for _, p := range s.due(now) {
+		//the post may have been cancelled since
+		if !s.begin(p) {
+			continue
+		}
+		log.Println("publishing scheduled post ", p.Name)
+		err := s.publish(p)
+		s.mu.Lock()
+		s.publishing = nil
+		s.mu.Unlock()
+		if err != nil {
+			log.Printf("error publishing scheduled post %s: %s\n", p.Name, err)
+			if errors.Is(err, errConflict) {
+				stuck[p] = err
+			}
+			failed++
+			continue
+		}
+		done[p] = true
+		published++
+	}
+	if published == 0 && len(stuck) == 0 {
+		return
+	}
+	//posts may have been added or cancelled while publishing
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var remaining []*scheduledPost
+	for _, p := range s.queue {
+		if err, ok := stuck[p]; ok {
+			p.Failed = err.Error()
+		}
+		if !done[p] {
+			remaining = append(remaining, p)
+		}
+	}
+	s.queue = remaining
+	if err := s.save(); err != nil {
+		log.Println("error saving schedule: ", err)
+	}
+	return
+}
+
+//begin marks p as being published if it's still queued
+func (s *scheduler) begin(p *scheduledPost) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range s.queue {
+		if q == p {
+			s.publishing = p
+			return true
+		}
+	}
+	return false
+}
+
+//due returns the posts due at now which haven't failed
+func (s *scheduler) due(now time.Time) []*scheduledPost {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*scheduledPost
+	for _, p := range s.queue {
+		if !p.At.After(now) && len(p.Failed) == 0 {
+			due = append(due, p)
+		}
+	}
+	return due
+}
+
+//save writes the queue to disk
+func (s *scheduler) save() error {
+	b, err := json.MarshalIndent(s.queue, "", "    ")
+	if err != nil {
+		return err
+	}
+	//write to a temp file first so a crash can't
+	//leave a half written queue
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blogposter-schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := path.Join(dir, "schedule.json")
+
+	var published []string
+	fail := true
+	publish := func(p *scheduledPost) error {
+		if p.Name == "flaky" && fail {
+			return errors.New("failed")
+		}
+		published = append(published, p.Name)
+		return nil
+	}
+	s, err := newScheduler(fpath, publish)
+	if err != nil {
+		t.Fatal("error creating scheduler: ", err)
+	}
+	now := time.Now()
+	for name, at := range map[string]time.Time{
+		"later": now.Add(time.Hour),
+		"due":   now.Add(-time.Minute),
+		"flaky": now.Add(-time.Hour),
+	} {
+		err = s.Add(&scheduledPost{Name: name, At: at, Files: map[string][]byte{"content/post/" + name + ".md": []byte(name)}})
+		if err != nil {
+			t.Fatal("error adding scheduled post: ", err)
+		}
+	}
+	if q := s.Queue(); q[0].Name != "flaky" || q[2].Name != "later" {
+		t.Errorf("queue not in publish order")
+	}
+
+	s.publishDue(now)
+	if len(published) != 1 || published[0] != "due" {
+		t.Errorf("expected only due post to be published got %v", published)
+	}
+
+	//reload the queue from disk
+	s, err = newScheduler(fpath, publish)
+	if err != nil {
+		t.Fatal("error reloading scheduler: ", err)
+	}
+	q := s.Queue()
+	if len(q) != 2 || q[0].Name != "flaky" || string(q[0].Files["content/post/flaky.md"]) != "flaky" {
+		t.Fatalf("unexpected reloaded queue: %v", q)
+	}
+	fail = false
+	s.publishDue(now.Add(2 * time.Hour))
+	if len(published) != 3 || len(s.Queue()) != 0 {
+		t.Errorf("expected all posts to be published got %v", published)
+	}
+}
+
+func TestSchedulerPublishUnlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blogposter-schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var s *scheduler
+	//publishing doesn't block reading or adding to the queue
+	publish := func(p *scheduledPost) error {
+		if q := s.Queue(); len(q) != 1 {
+			t.Errorf("expected publishing post to stay queued got %v", q)
+		}
+		return s.Add(&scheduledPost{Name: "added", At: time.Now().Add(time.Hour)})
+	}
+	if s, err = newScheduler(path.Join(dir, "schedule.json"), publish); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Add(&scheduledPost{Name: "due", At: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if published, _ := s.publishDue(time.Now()); published != 1 {
+		t.Errorf("expected 1 published post got %d", published)
+	}
+	if q := s.Queue(); len(q) != 1 || q[0].Name != "added" {
+		t.Errorf("expected post added while publishing to stay queued got %v", q)
+	}
+}
+
+func TestSchedulerFailedAndCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blogposter-schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	attempts := 0
+	publish := func(p *scheduledPost) error {
+		attempts++
+		return fmt.Errorf("%s %w", p.Name, errConflict)
+	}
+	s, err := newScheduler(path.Join(dir, "schedule.json"), publish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Add(&scheduledPost{Name: "conflict", At: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	//a conflicting post is marked failed and not retried
+	if _, failed := s.publishDue(time.Now()); failed != 1 {
+		t.Errorf("expected 1 failed post got %d", failed)
+	}
+	if _, failed := s.publishDue(time.Now()); failed != 0 {
+		t.Errorf("expected failed post not to be retried got %d failures", failed)
+	}
+	q := s.Queue()
+	if attempts != 1 || len(q) != 1 || len(q[0].Failed) == 0 {
+		t.Fatalf("expected one failed attempt got %d %+v", attempts, q)
+	}
+
+	if _, err = s.Cancel(q[0].ID); err != nil {
+		t.Fatal("error cancelling failed post: ", err)
+	}
+	if len(s.Queue()) != 0 {
+		t.Error("cancelled post still queued")
+	}
+	if _, err = s.Cancel(q[0].ID); !errors.Is(err, errNotScheduled) {
+		t.Errorf("expected cancelling twice to fail got %v", err)
+	}
+}
+
+func TestSchedulerCancelWhilePublishing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blogposter-schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var s *scheduler
+	var published []string
+	//the first post cancels itself and the next post while publishing
+	publish := func(p *scheduledPost) error {
+		published = append(published, p.Name)
+		q := s.Queue()
+		if _, err := s.Cancel(q[0].ID); !errors.Is(err, errPublishing) {
+			t.Errorf("expected cancelling the publishing post to fail got %v", err)
+		}
+		if len(q) > 1 {
+			if _, err := s.Cancel(q[1].ID); err != nil {
+				t.Error("error cancelling queued post: ", err)
+			}
+		}
+		return nil
+	}
+	if s, err = newScheduler(path.Join(dir, "schedule.json"), publish); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"first", "cancelled"} {
+		if err = s.Add(&scheduledPost{Name: name, At: time.Now().Add(time.Duration(i-2) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := s.publishDue(time.Now()); n != 1 || len(published) != 1 || published[0] != "first" {
+		t.Errorf("expected only the first post to be published got %v", published)
+	}
+	if q := s.Queue(); len(q) != 0 {
+		t.Errorf("expected an empty queue got %v", q)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -9,10 +10,13 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"path"
 	"regexp"
 	"strings"
 	"time"
@@ -21,7 +25,6 @@ import (
 	"google.golang.org/api/drive/v3"
 )
 
-var posturlregxp = regexp.MustCompile(`(?m)\/post\/[a-zA-Z0-9]+`)
 var assetextregexp = regexp.MustCompile(`(?m)(?:(?:.png)|(?:.css)|(?:.js))`)
 
 var input = template.Must(template.New("input").Parse(`<!DOCTYPE html>
@@ -44,6 +47,12 @@ var input = template.Must(template.New("input").Parse(`<!DOCTYPE html>
             <input type="text" id="articleSummary" name="summary" value="{{ .Fm.Summary }}"> <br>
             <label for="articleTags">Tags:</label>
             <input type="text" id="articleTags" name="tags" value="{{ .Fm.TagList }}"> <br>
+            <label for="articleDraft">Draft:</label>
+            <input type="checkbox" id="articleDraft" name="draft" value="true" {{if .Fm.Draft}}checked{{end}}> <br>
+            <label for="articlePublishDate">Publish Date (leave empty to publish now):</label>
+            <input type="datetime-local" id="articlePublishDate" name="publishdate"> <br>
+            <label for="articleTimezone">Timezone:</label>
+            <input type="text" id="articleTimezone" name="timezone" value="{{ .Timezone }}"> <br>
             <label for="fileinput">File:</label>
 			{{if .DriveFiles }}
 			<select id="fileinput" name="drivefile">
@@ -55,18 +64,193 @@ var input = template.Must(template.New("input").Parse(`<!DOCTYPE html>
 			{{ else }}
 			<input type="file" id="fileinput" name="userfile"> <br>
 			{{ end }}
+            <label for="cover">Cover Image:</label>
+			<select id="cover" name="cover">
+				<option value="">{{if .Fm.Img}}keep current{{else}}none{{end}}</option>
+				<option value="first">first image in document</option>
+				<option value="upload">uploaded file</option>
+				{{if .DriveImages}}<option value="drive">google drive image</option>{{end}}
+			</select><br>
+			<input type="file" id="coverfile" name="coverfile" accept="image/*"> <br>
+			{{if .DriveImages }}
+			<select id="coverdrive" name="coverdrive">
+				{{ range .DriveImages }}
+				<option value="{{.Id}}">{{.Name}}</option>
+				{{end}}
+			</select><br>
+			{{ else if .DrivePicker }}
+			<a href="{{.DrivePicker}}">pick a google drive cover</a><br>
+			{{ end }}
             
             <input type="submit" id="btnSubmit">
 			<input type="hidden" name="postname" value="{{ .Postname }}">
+			<input type="hidden" name="csrf" value="{{ .CSRF }}">
         </form>
     </body>
 </html>`))
 
+var changesPage = template.Must(template.New("changes").Parse(`<!DOCTYPE html>
+<html lang="en">
+    <head>
+        <meta charset="UTF-8">
+        <meta name="viewport" content="width=device-width, initial-scale=1.0">
+        <title>Pending Changes</title>
+    </head>
+    <body>
+        <h1>Pending Changes</h1>
+        <table>
+            <tr><th>Post</th><th>Message</th><th>Staged</th><th>Publish At</th><th></th></tr>
+            {{ range .Changes }}
+            <tr>
+                <td><a href="{{.URL}}">{{.Name}}</a></td>
+                <td>{{.Msg}}</td>
+                <td>{{.Created.Format "2006-01-02 15:04"}}</td>
+                <td>{{if not .PublishAt.IsZero}}{{.PublishAt.Format "2006-01-02 15:04 MST"}}{{end}}</td>
+                <td>
+                    <form action="/publish" method="post"><input type="hidden" name="csrf" value="{{$.CSRF}}"><input type="hidden" name="change" value="{{.ID}}"><input type="submit" value="publish"></form>
+                    <form action="/abort" method="post"><input type="hidden" name="csrf" value="{{$.CSRF}}"><input type="hidden" name="change" value="{{.ID}}"><input type="submit" value="abort"></form>
+                </td>
+            </tr>
+            {{ else }}
+            <tr><td colspan="5">nothing is waiting to be published</td></tr>
+            {{ end }}
+        </table>
+        <h2>Scheduled</h2>
+        <table>
+            <tr><th>Post</th><th>Message</th><th>Publish At</th><th></th></tr>
+            {{ range .Scheduled }}
+            <tr>
+                <td>{{.Name}}</td>
+                <td>{{.Msg}}</td>
+                <td>{{.At.Format "2006-01-02 15:04 MST"}}{{if .Failed}}<br>failed: {{.Failed}}{{end}}</td>
+                <td><form action="/unschedule" method="post"><input type="hidden" name="csrf" value="{{$.CSRF}}"><input type="hidden" name="id" value="{{.ID}}"><input type="submit" value="cancel"></form></td>
+            </tr>
+            {{ else }}
+            <tr><td colspan="4">nothing is scheduled</td></tr>
+            {{ end }}
+        </table>
+    </body>
+</html>`))
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html lang="en">
+    <head>
+        <meta charset="UTF-8">
+        <meta name="viewport" content="width=device-width, initial-scale=1.0">
+        <title>Build Status</title>
+    </head>
+    <body>
+        <h1>Build Status</h1>
+        <p>{{.Builds}} builds completed. {{if .Failing}}The last build failed.{{else}}The last build succeeded.{{end}}</p>
+        {{ with .Failure }}
+        <h2>Latest Failure</h2>
+        <p>{{.At.Format "2006-01-02 15:04:05"}}</p>
+        <pre>{{.Err}}</pre>
+        {{ end }}
+        {{ if .Post }}
+        <p>Reported in <a href="{{.PostURL}}">{{.Post}}</a>{{if .Change}} which has a pending change
+        <form action="/abort" method="post"><input type="hidden" name="csrf" value="{{.CSRF}}"><input type="hidden" name="change" value="{{.Change}}"><input type="submit" value="abort"></form>{{end}}</p>
+        {{ end }}
+        {{ if .Pushes }}
+        <h2>Post Push Actions</h2>
+        <table>
+            <tr><th>Post</th><th>Started</th><th>Action</th><th>Attempts</th><th>Result</th></tr>
+            {{ range .Pushes }}
+            {{ $run := . }}
+            {{ range .Results }}
+            <tr>
+                <td>{{$run.Post}}</td>
+                <td>{{$run.Started.Format "2006-01-02 15:04:05"}}</td>
+                <td>{{.Name}}</td>
+                <td>{{.Attempts}}</td>
+                <td>{{if .Err}}failed: {{.Err}}{{else}}ok{{end}}</td>
+            </tr>
+            {{ if .Output }}<tr><td colspan="5"><pre>{{.Output}}</pre></td></tr>{{ end }}
+            {{ else }}
+            <tr><td>{{$run.Post}}</td><td>{{$run.Started.Format "2006-01-02 15:04:05"}}</td><td colspan="3">{{if $run.Done}}no actions{{else}}running{{end}}</td></tr>
+            {{ end }}
+            {{ end }}
+        </table>
+        {{ end }}
+        <h2>Hugo Output</h2>
+        <pre>{{ range .Output }}{{.}}
+{{ end }}</pre>
+    </body>
+</html>`))
+
+var publishPage = template.Must(template.New("publish").Parse(`<!DOCTYPE html>
+<html lang="en">
+    <head>
+        <meta charset="UTF-8">
+        <meta name="viewport" content="width=device-width, initial-scale=1.0">
+        <title>Published</title>
+    </head>
+    <body>
+        <h1>{{.Message}}</h1>
+        {{ if .PullRequest }}<p>Waiting for review in pull request <a id="pullRequest" href="{{.PullRequest}}">{{.PullRequest}}</a></p>{{ end }}
+        {{ if .Results }}
+        <table>
+            <tr><th>Action</th><th>Attempts</th><th>Result</th></tr>
+            {{ range .Results }}
+            <tr>
+                <td>{{.Name}}</td>
+                <td>{{.Attempts}}</td>
+                <td>{{if .Err}}failed: {{.Err}}{{else}}ok{{end}}</td>
+            </tr>
+            {{ if .Output }}<tr><td colspan="3"><pre>{{.Output}}</pre></td></tr>{{ end }}
+            {{ end }}
+        </table>
+        {{ end }}
+        {{ if .PostPush }}<p>Post push actions are still running. Their results are shown on the <a href="/status">status page</a>.</p>{{ end }}
+    </body>
+</html>`))
+
+//PublishForm is the data for the publish result page
+type PublishForm struct {
+	Message string
+	//PullRequest is the url of the pull request in review mode
+	PullRequest string
+	Results     []*actionResult
+	//PostPush is set if post push actions are still running
+	PostPush bool
+}
+
+//ChangesForm is the data for the changes page
+type ChangesForm struct {
+	Changes   []*changeView
+	Scheduled []*scheduledPost
+	CSRF      string
+}
+
+//StatusForm is the data for the status page
+type StatusForm struct {
+	*BuildStatus
+	//Pushes are the recent post push action runs
+	Pushes []*pushRun
+	CSRF   string
+}
+
+//changeView exposes a pending change to templates
+type changeView struct {
+	ID        string
+	Name      string
+	URL       string
+	Msg       string
+	Created   time.Time
+	PublishAt time.Time
+}
+
 type InputForm struct {
-	Action     string
-	Fm         *frontMatter
-	Postname   string
-	DriveFiles []*drive.File
+	Action      string
+	Fm          *frontMatter
+	Postname    string
+	DriveFiles  []*drive.File
+	DriveImages []*drive.File
+	//DrivePicker is the url of the form listing
+	//drive images to pick a cover from
+	DrivePicker string
+	Timezone    string
+	CSRF        string
 }
 
 func (i *InputForm) CurrentPath() string {
@@ -81,7 +265,8 @@ func (i *InputForm) CurrentPath() string {
 }
 
 type ServerConfig struct {
-	//Author name to put on posts
+	//Author name to put on posts by users
+	//without their own author set
 	Author string `json:"author"`
 	//Port for cms app to listen on
 	Port string `json:"port"`
@@ -101,91 +286,230 @@ type ServerConfig struct {
 	BaseUrl string `json:"baseurl"`
 	//Remote url to git repository
 	RemoteUrl string `json:"remoteurl"`
+	//GitAuth for the remote. Defaults to basic
+	//auth with the username and token
+	GitAuth *GitAuth `json:"gitauth"`
 	//google api config for drive integration
-	GAPI *GAPIConfig
+	GAPI *GAPIConfig `json:"gapi"`
+	//document converter to use: pandoc (default) or docx
+	Converter string `json:"converter"`
+	//default IANA timezone for publish dates
+	Timezone string `json:"timezone"`
+	//file scheduled posts are persisted to
+	//defaults to a file in the repo's .git dir
+	ScheduleFile string `json:"schedulefile"`
+	//hugo binary. defaults to hugo on the PATH
+	HugoPath string `json:"hugopath"`
+	//port for the hugo preview server. defaults to 1313
+	PreviewPort string `json:"previewport"`
+	//hugo environment for the preview server e.g. staging
+	Environment string `json:"environment"`
+	//extra flags passed to hugo server. hugo binds to
+	//127.0.0.1 unless they include --bind
+	HugoFlags []string `json:"hugoflags"`
+	//site dir posts are written to. defaults to content/post
+	ContentDir string `json:"contentdir"`
+	//times in a row the hugo preview server can fail
+	//before it is no longer restarted. defaults to 5
+	HugoMaxFailures int `json:"hugomaxfailures"`
+	//production build run when a change is published
+	Build *BuildConfig `json:"build"`
+	//Review opens pull requests for published changes
+	//instead of pushing them to the checked out branch
+	Review *ReviewConfig `json:"review"`
+	//actions run in order after a post is pushed
+	PostPush []*PostPushAction `json:"postpush"`
+	//Users allowed to sign in to the cms. Anyone can use
+	//the cms if no users or trusted header are set
+	Users []*User `json:"users"`
+	//header a reverse proxy sets to the name of the
+	//signed in user e.g. X-Forwarded-User
+	TrustedHeader string `json:"trustedheader"`
+	//addresses or cidrs the trusted header is accepted from
+	TrustedProxies []string `json:"trustedproxies"`
+	//let anyone view the preview pages without signing in
+	PublicPreview bool `json:"publicpreview"`
 }
 
-type postpushfunc func() error
+//postpushfunc runs after a post is pushed
+//returning the results of its actions
+type postpushfunc func(ev *pushEvent) []*actionResult
 
-var defaultpostpush postpushfunc = func() error {
-	return nil
-}
-
-func ReadServerConfig(fpath string) (*ServerConfig, error) {
-	log.Println("reading config file " + fpath)
-	b, err := ioutil.ReadFile(fpath)
-	if err != nil {
-		return nil, err
-	}
-	conf := new(ServerConfig)
-	err = json.Unmarshal(b, conf)
-	return conf, err
-}
+//rebuildTimeout is how long to wait for hugo to
+//rebuild after staging a change
+var rebuildTimeout = time.Second * 10
 
 type server struct {
-	stopped  chan struct{}
-	hugo     *HugoRepo
-	config   *ServerConfig
-	PostPush postpushfunc
-	drive    *GDriveClient
+	//host:port of the hugo preview server
+	hugoAddr  string
+	stopped   chan struct{}
+	hugo      *HugoRepo
+	config    *ServerConfig
+	PostPush  postpushfunc
+	drive     *GDriveClient
+	scheduler *scheduler
+	//supervisor of the hugo preview server
+	preview *supervisor
+	//signed in users
+	sessions *sessions
+	//post push actions running or recently run
+	pushes *pushRuns
+	//lock on the repo's worktree
+	lock *repoLock
 }
 
 func NewServer(config *ServerConfig) *server {
-	return &server{config: config, stopped: make(chan struct{}), PostPush: defaultpostpush}
+	s := &server{config: config, stopped: make(chan struct{}), hugoAddr: "localhost:1313", sessions: newSessions(), pushes: new(pushRuns)}
+	s.PostPush = func(ev *pushEvent) []*actionResult {
+		return runPostPush(s.config.PostPush, ev)
+	}
+	return s
 }
 
-func (s *server) Start(ctx context.Context) (chan error, error) {
+func (s *server) Start(ctx context.Context) error {
 	if s.config == nil {
 		log.Fatal("server config is nil")
 	}
+	if len(s.config.Port) == 0 {
+		return errors.New("missing required config: port")
+	}
+	if err := s.config.Validate(); err != nil {
+		return err
+	}
 
-	var err error
-	//create google drive api client
-	if len(s.config.GAPI.PrivateKeyID) > 0 {
-		s.drive, err = NewGDriveCli(ctx, s.config.GAPI)
-		if err != nil {
-			return nil, errors.New("error creating google drive api client: " + err.Error())
-		}
+	if err := s.initDrive(ctx); err != nil {
+		return err
+	}
+	if err := s.initRepo(); err != nil {
+		return err
+	}
+	//check external dependencies now rather than at first use
+	if err := logChecks(preflight(ctx, s.config)); err != nil {
+		return err
 	}
+	if err := s.initScheduler(); err != nil {
+		return err
+	}
+	//start publishing scheduled posts
+	go s.scheduler.Run(ctx, time.Minute)
 
-	//start servers
-	//initialize repo
+	//start hugo test server. The cms keeps running if
+	//it fails so its state can be checked at /healthz
+	s.preview = newSupervisor(s.hugo.StartServer, s.config.HugoMaxFailures)
+	go s.runPreview(ctx)
 
-	//check if repo exists first, if not: clone it
-	ok, err := func() (bool, error) {
-		_, err := os.Stat(s.config.Path)
-		if err == nil {
-			return true, nil
-		}
-		if os.IsNotExist(err) {
-			return false, nil
-		}
-		return false, err
-	}()
+	//start cms webserver
+	go s.startHttpServer(s.config.Port)
+	return nil
+}
+
+//runPreview supervises the hugo server until ctx is done.
+//The repo stays locked while the cms is running even
+//if the supervisor gives up restarting hugo
+func (s *server) runPreview(ctx context.Context) {
+	if err := s.preview.Run(ctx); err != nil {
+		log.Println("hugo server not restarted: ", err)
+	}
+	<-ctx.Done()
+	if err := s.lock.Unlock(); err != nil {
+		log.Println("error unlocking repo: ", err)
+	}
+	close(s.stopped)
+}
+
+//initDrive creates the google drive client if configured
+func (s *server) initDrive(ctx context.Context) error {
+	if s.config.GAPI == nil || len(s.config.GAPI.PrivateKeyID) == 0 {
+		return nil
+	}
+	var err error
+	s.drive, err = NewGDriveCli(ctx, s.config.GAPI)
 	if err != nil {
-		log.Fatal("error checking for repo dir: ", err)
+		return errors.New("error creating google drive api client: " + err.Error())
 	}
-	if !ok {
-		//get the repo
-		if CloneRepo(s.config.RemoteUrl, s.config.Path) != nil {
-			log.Fatal("error cloning repo from remoteurl: ", err)
+	return nil
+}
+
+//initRepo opens the blog repo cloning it first if it
+//doesn't exist. The config must have been validated
+func (s *server) initRepo() error {
+	auth, err := s.config.AuthMethod()
+	if err != nil {
+		return errors.New("git auth: " + err.Error())
+	}
+	//check if repo exists first, if not: clone it
+	if _, err := os.Stat(s.config.Path); os.IsNotExist(err) {
+		if err = CloneRepo(s.config.RemoteUrl, s.config.Path, auth); err != nil {
+			return errors.New("error cloning repo from remoteurl: " + err.Error())
 		}
+	} else if err != nil {
+		return errors.New("error checking for repo dir: " + err.Error())
+	}
+	//the server and cli commands can't share the worktree
+	if s.lock, err = lockRepo(s.config.Path); err != nil {
+		return err
 	}
 
-	s.hugo, err = NewHugoRepo(s.config.Path, s.config.Username, s.config.Token, s.config.BaseUrl, s.config.Name, s.config.Email)
+	s.hugo, err = NewHugoRepo(s.config.Path, auth, s.config.BaseUrl, s.config.Name, s.config.Email)
 	if err != nil {
-		return nil, errors.New("error initializing repo: " + err.Error())
+		return errors.New("error initializing repo: " + err.Error())
 	}
 	s.hugo.test = s.config.Test
-	//start hugo test server
-	hugoErr, err := s.hugo.StartServer(ctx, s.stopped)
+	s.hugo.converter, err = NewConverter(s.config.Converter)
 	if err != nil {
-		return nil, errors.New("error starting hugo test server: " + err.Error())
+		return err
+	}
+	s.configurePreview()
+	s.hugo.build = s.config.Build
+	if s.config.Review != nil {
+		s.hugo.review = s.config.Review
+		s.hugo.forge, err = newForge(s.config.Review, gitToken(auth, s.config.Token))
 	}
+	return err
+}
 
-	//start cms webserver
-	go s.startHttpServer(s.config.Port)
-	return hugoErr, nil
+//initScheduler loads the queue of scheduled posts
+func (s *server) initScheduler() error {
+	schedfile := s.config.ScheduleFile
+	if len(schedfile) == 0 {
+		schedfile = path.Join(s.config.Path, ".git", "blogposter-schedule.json")
+	}
+	var err error
+	s.scheduler, err = newScheduler(schedfile, s.publishScheduled)
+	if err != nil {
+		return errors.New("error loading schedule: " + err.Error())
+	}
+	return nil
+}
+
+//configurePreview applies the hugo preview server
+//config to the repo and proxy
+func (s *server) configurePreview() {
+	if len(s.config.HugoPath) > 0 {
+		s.hugo.preview.bin = s.config.HugoPath
+	}
+	if len(s.config.PreviewPort) > 0 {
+		s.hugo.preview.port = s.config.PreviewPort
+	}
+	s.hugo.preview.environment = s.config.Environment
+	s.hugo.preview.flags = s.config.HugoFlags
+	if len(s.config.ContentDir) > 0 {
+		s.hugo.contentDir = s.config.ContentDir
+	}
+	s.hugoAddr = "localhost:" + s.hugo.preview.port
+}
+
+//waitForRebuild waits for hugo to rebuild the site
+//after build n returning an error if the build failed.
+//A rebuild that takes too long is logged but not treated
+//as an error so the user is still shown the preview
+func (s *server) waitForRebuild(n uint64) error {
+	err := s.hugo.WaitForRebuild(n, rebuildTimeout)
+	if err == errRebuildTimeout {
+		log.Println(err)
+		return nil
+	}
+	return err
 }
 
 func serverError(msgTemplate string, w http.ResponseWriter, err error) bool {
@@ -193,7 +517,14 @@ func serverError(msgTemplate string, w http.ResponseWriter, err error) bool {
 		//write error
 		msg := fmt.Sprintf(msgTemplate, err)
 		log.Println(msg)
-		w.WriteHeader(http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errInvalidPostName):
+			status = http.StatusBadRequest
+		case errors.Is(err, errPublishing):
+			status = http.StatusConflict
+		}
+		w.WriteHeader(status)
 		_, err = w.Write([]byte(msg))
 		if err != nil {
 			log.Printf("error writing error message to response body: %s\n", err)
@@ -203,6 +534,62 @@ func serverError(msgTemplate string, w http.ResponseWriter, err error) bool {
 	return false
 }
 
+//documentMIME returns the MIME type of uploaded document
+//file preferring the file extension over the browser
+//supplied content type. Uploads with neither are sniffed
+func documentMIME(file io.ReaderAt, hdr *multipart.FileHeader) string {
+	if m := extMIME(hdr.Filename); len(m) > 0 {
+		return m
+	}
+	if m, _, err := mime.ParseMediaType(hdr.Header.Get("Content-Type")); err == nil {
+		if _, ok := pandocFormats[m]; ok {
+			return m
+		}
+	}
+	return sniffMIME(file)
+}
+
+//sniffMIME returns the odt MIME type for an OpenDocument
+//file, which starts with its uncompressed MIME type, and
+//docx for anything else as uploads always were
+func sniffMIME(file io.ReaderAt) string {
+	//the zip local header and "mimetype" file name take 38 bytes
+	b := make([]byte, 38+len(odtMIME))
+	if _, err := file.ReadAt(b, 0); err == nil && bytes.HasSuffix(b, []byte(odtMIME)) {
+		return odtMIME
+	}
+	return docxMIME
+}
+
+//extMIME returns the MIME type of a document
+//file by its extension or "" if it's unknown
+func extMIME(fname string) string {
+	switch strings.ToLower(path.Ext(fname)) {
+	case ".docx":
+		return docxMIME
+	case ".odt":
+		return odtMIME
+	}
+	return ""
+}
+
+//actionForm returns an inline form posting name=value
+//to action with the csrf token, shown as an icon button
+func actionForm(action, name, value, csrf, title, icon string) string {
+	esc := template.HTMLEscapeString
+	field := ""
+	if len(name) > 0 {
+		field = fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, esc(name), esc(value))
+	}
+	return fmt.Sprintf(`
+            <form action="%s" method="post" style="display:inline">
+                <input type="hidden" name="csrf" value="%s">%s
+                <button type="submit" title="%s" style="background:none;border:none;padding:0;cursor:pointer">
+                    <i class="fa %s fa-fw" aria-hidden="true"></i>
+                </button>
+            </form>`, action, esc(csrf), field, esc(title), icon)
+}
+
 func PostnameFromURL(url string) string {
 	//drop off querystring
 	url = strings.Split(url, "?")[0]
@@ -215,9 +602,234 @@ func PostnameFromURL(url string) string {
 	return urlparts[len(urlparts)-1]
 }
 
+//postPush starts the post push actions for a pushed post
+//in the background returning their run or nil if there
+//are no actions to run
+func (s *server) postPush(post, msg string) *pushRun {
+	if s.config.Test || len(s.config.PostPush) == 0 {
+		return nil
+	}
+	ev := &pushEvent{
+		Post:    post,
+		Message: msg,
+		Path:    s.hugo.PostURL(post),
+		Time:    time.Now(),
+	}
+	return s.pushes.start(post, func() []*actionResult {
+		return s.PostPush(ev)
+	})
+}
+
+//publishResult is the outcome of publishing a change
+type publishResult struct {
+	//Scheduled is set if the change was queued for its publish date
+	Scheduled *scheduledPost
+	//Review is set if the change is waiting for review
+	//in a pull request instead of published
+	Review bool
+	//PullRequest is the url of the change's pull request in review mode
+	PullRequest string
+	//Results of pushing the built site if it failed
+	Results []*actionResult
+	//PostPush is the run of the post push actions
+	//in the background. nil if there are none
+	PostPush *pushRun
+}
+
+//publishChange publishes change ch running the post push
+//actions. Changes with a future publish date are queued
+//instead and returned as the scheduled post
+func (s *server) publishChange(ch *change) (*publishResult, error) {
+	if ch.publishAt.After(time.Now()) {
+		sp, err := s.hugo.Schedule(ch.id)
+		if err != nil {
+			return nil, err
+		}
+		return &publishResult{Scheduled: sp}, s.scheduler.Add(sp)
+	}
+	pr, err := s.hugo.Publish(ch.id)
+	if err != nil && !errors.Is(err, errSitePush) {
+		return nil, err
+	}
+	return s.published(ch.name, ch.msg, pr, err), nil
+}
+
+//published returns the result of publishing post starting
+//its post push actions unless it is waiting for review.
+//siteErr is the error pushing the built site if it failed
+//which is shown as an action result as the post is live
+func (s *server) published(post, msg, pr string, siteErr error) *publishResult {
+	if s.config.Review != nil {
+		return &publishResult{Review: true, PullRequest: pr}
+	}
+	res := &publishResult{PostPush: s.postPush(post, msg)}
+	if siteErr != nil {
+		res.Results = []*actionResult{{Name: "push site branch", Attempts: 1, Err: siteErr.Error()}}
+	}
+	return res
+}
+
+//actionResults returns the site push and post push action
+//results waiting up to postPushWait for the post push
+//actions. running is set if they didn't finish in time
+func (r *publishResult) actionResults() (results []*actionResult, running bool) {
+	results = append(results, r.Results...)
+	if r.PostPush == nil {
+		return results, false
+	}
+	pushed, ok := r.PostPush.WaitFor(postPushWait)
+	if !ok {
+		return results, true
+	}
+	return append(results, pushed...), false
+}
+
+//message returns the message shown after publishing
+//post with verb e.g. published. Posts waiting for
+//review aren't published yet
+func (r *publishResult) message(verb, post string) string {
+	if r.Review {
+		return fmt.Sprint("opened a review pull request for ", post)
+	}
+	return fmt.Sprintf("successfully %s %s", verb, post)
+}
+
+//publishScheduled deploys a scheduled post. Failed post
+//push actions are only logged as the post is already live
+func (s *server) publishScheduled(p *scheduledPost) error {
+	pr, err := s.hugo.PublishFiles(p.Name, p.Msg, p.Base, p.Files, p.Author)
+	if err != nil && !errors.Is(err, errSitePush) {
+		return err
+	}
+	if len(pr) > 0 {
+		log.Printf("opened pull request %s for scheduled post %s\n", pr, p.Name)
+	}
+	for _, res := range s.published(p.Name, p.Msg, pr, err).Results {
+		log.Printf("%s failed for %s: %s\n", res.Name, p.Name, res.Err)
+	}
+	return nil
+}
+
+//timezone returns the default timezone for publish dates
+func (s *server) timezone() string {
+	if len(s.config.Timezone) > 0 {
+		return s.config.Timezone
+	}
+	return "Local"
+}
+
+//formDocument returns the document selected in an
+//upload form and its MIME type
+func (s *server) formDocument(req *http.Request) (io.ReadCloser, string, error) {
+	if id := req.FormValue("drivefile"); len(id) > 0 {
+		file, err := s.drive.GetFile(id)
+		if err != nil {
+			return nil, "", errors.New("get drivefile: " + err.Error())
+		}
+		return file, docxMIME, nil
+	}
+	file, hdr, err := req.FormFile("userfile")
+	if err != nil {
+		return nil, "", errors.New("get userfile: " + err.Error())
+	}
+	return file, documentMIME(file, hdr), nil
+}
+
+//author returns the author name of posts by the
+//signed in user defaulting to the configured author
+func (s *server) author(req *http.Request) string {
+	if u := requestUser(req); u != nil && len(u.Author) > 0 {
+		return u.Author
+	}
+	return s.config.Author
+}
+
+//gitAuthor returns the git identity of the signed in user
+//or nil to commit as the repo's identity
+func gitAuthor(req *http.Request) *Identity {
+	if u := requestUser(req); u != nil {
+		return u.Identity()
+	}
+	return nil
+}
+
+//formDetails returns the post details set in an upload form
+func (s *server) formDetails(req *http.Request) (*postDetails, error) {
+	d := &postDetails{
+		Title:     strings.TrimSpace(req.FormValue("title")),
+		Tags:      strings.ToLower(strings.TrimSpace(req.FormValue("tags"))),
+		Summary:   strings.TrimSpace(req.FormValue("summary")),
+		Author:    s.author(req),
+		Draft:     req.FormValue("draft") == "true",
+		GitAuthor: gitAuthor(req),
+	}
+	if date := req.FormValue("publishdate"); len(date) > 0 {
+		tz := req.FormValue("timezone")
+		if len(tz) == 0 {
+			tz = s.timezone()
+		}
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, errors.New("timezone: " + err.Error())
+		}
+		d.Date, err = time.ParseInLocation("2006-01-02T15:04", date, loc)
+		if err != nil {
+			return nil, errors.New("publish date: " + err.Error())
+		}
+	}
+	switch req.FormValue("cover") {
+	case "first":
+		d.Cover = &Cover{FirstImage: true}
+	case "upload":
+		file, hdr, err := req.FormFile("coverfile")
+		if err != nil {
+			return nil, errors.New("get coverfile: " + err.Error())
+		}
+		defer file.Close()
+		d.Cover = &Cover{Name: hdr.Filename}
+		d.Cover.Data, err = ioutil.ReadAll(file)
+		if err != nil {
+			return nil, errors.New("read coverfile: " + err.Error())
+		}
+	case "drive":
+		if s.drive == nil {
+			return nil, errors.New("google drive is not configured")
+		}
+		name, b, err := s.drive.GetImage(req.FormValue("coverdrive"))
+		if err != nil {
+			return nil, errors.New("get drive cover: " + err.Error())
+		}
+		d.Cover = &Cover{Name: name, Data: b}
+	}
+	return d, nil
+}
+
+//driveImages returns the drive images to pick a cover
+//from if the form was requested with the drive picker.
+//Otherwise it returns the url of the form with the picker
+//or nothing if drive isn't configured
+func (s *server) driveImages(req *http.Request) ([]*drive.File, string, error) {
+	if s.drive == nil {
+		return nil, "", nil
+	}
+	q := req.URL.Query()
+	if len(q.Get("drivecover")) == 0 {
+		q.Set("drivecover", "true")
+		return nil, req.URL.Path + "?" + q.Encode(), nil
+	}
+	images, err := s.drive.ListImages()
+	return images, "", err
+}
+
 func (s *server) startHttpServer(port string) {
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), s.handler()))
+}
 
-	http.HandleFunc("/upload", func(w http.ResponseWriter, req *http.Request) {
+//handler returns the cms routes and hugo preview proxy
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/upload", stateChanging(func(w http.ResponseWriter, req *http.Request) {
 		success := func(prefix string, err error) bool {
 			return !serverError(fmt.Sprintf("error handling upload: %s: %%s", prefix), w, err)
 		}
@@ -228,47 +840,39 @@ func (s *server) startHttpServer(port string) {
 		}
 
 		//get file from form
-		var file io.ReadCloser
-		if id := req.FormValue("drivefile"); len(id) > 0 {
-			file, err = s.drive.GetFile(id)
-			if !success("get drivefile", err) {
-				return
-			}
-		} else {
-			//get file from form
-			file, _, err = req.FormFile("userfile")
-			if !success("get userfile", err) {
-				return
-			}
+		file, mime, err := s.formDocument(req)
+		if !success("get document", err) {
+			return
 		}
 		defer file.Close()
 
 		//get front matter from form
-		title := strings.TrimSpace(req.FormValue("title"))
-		tags := strings.ToLower(strings.TrimSpace(req.FormValue("tags")))
-		summary := strings.TrimSpace(req.FormValue("summary"))
+		details, err := s.formDetails(req)
+		if !success("get details", err) {
+			return
+		}
 
 		//create post in repo
-		if !success("hugo new", s.hugo.New(file, title, tags, summary, s.config.Author)) {
+		builds := s.hugo.Builds()
+		ch, err := s.hugo.New(file, mime, details)
+		if !success("hugo new", err) {
 			return
 		}
-		//set commit message
-		if s.hugo.onDeck == nil {
-			success("set commit messge", errors.New("hugo onDeck is nil"))
-		}
-		s.hugo.onDeck.msg = "published " + s.hugo.onDeck.name
 		//get user provided commit msg
 		if umsg := req.URL.Query().Get("msg"); len(umsg) > 0 {
-			s.hugo.onDeck.msg = umsg
+			if !success("set commit message", s.hugo.SetMessage(ch.id, umsg)) {
+				return
+			}
 		}
 		//wait for hugo to rebuild
-		//TODO: add a channel for this?
-		time.Sleep(time.Second * 4)
+		if !success("hugo rebuild", s.waitForRebuild(builds)) {
+			return
+		}
 		//execute publish template
-		http.Redirect(w, req, fmt.Sprintf("/post/%s/?redirected=1", s.hugo.onDeck.name), int(http.StatusTemporaryRedirect))
-	})
+		http.Redirect(w, req, s.hugo.PostURL(ch.name)+"?redirected=1", int(http.StatusTemporaryRedirect))
+	}))
 
-	http.HandleFunc("/replace", func(w http.ResponseWriter, req *http.Request) {
+	mux.HandleFunc("/replace", stateChanging(func(w http.ResponseWriter, req *http.Request) {
 		success := func(prefix string, err error) bool {
 			return !serverError(fmt.Sprintf("error handling upload: %s: %%s", prefix), w, err)
 		}
@@ -277,85 +881,162 @@ func (s *server) startHttpServer(port string) {
 		if !success("parse form", err) {
 			return
 		}
+
 		//get file from form
-		var file io.ReadCloser
-		if id := req.FormValue("drivefile"); len(id) > 0 {
-			file, err = s.drive.GetFile(id)
-			if !success("get drivefile", err) {
-				return
-			}
-		} else {
-			//get file from form
-			file, _, err = req.FormFile("userfile")
-			if !success("get userfile", err) {
-				return
-			}
+		file, mime, err := s.formDocument(req)
+		if !success("get document", err) {
+			return
 		}
 		defer file.Close()
 
 		//get front matter from form
-		title := strings.TrimSpace(req.FormValue("title"))
-		tags := strings.ToLower(strings.TrimSpace(req.FormValue("tags")))
-		summary := strings.TrimSpace(req.FormValue("summary"))
+		details, err := s.formDetails(req)
+		if !success("get details", err) {
+			return
+		}
 		postname := strings.TrimSpace(req.FormValue("postname"))
 
 		//create post in repo
-		if !success("hugo new", s.hugo.Update(file, postname, title, tags, summary, s.config.Author)) {
+		builds := s.hugo.Builds()
+		ch, err := s.hugo.Update(file, mime, postname, details)
+		if !success("hugo new", err) {
 			return
 		}
-		//set commit message
-		if s.hugo.onDeck == nil {
-			success("set commit messge", errors.New("hugo onDeck is nil"))
-		}
-		s.hugo.onDeck.msg = "updated " + s.hugo.onDeck.name
 		//get user provided commit msg
 		if umsg := req.URL.Query().Get("msg"); len(umsg) > 0 {
-			s.hugo.onDeck.msg = umsg
+			if !success("set commit message", s.hugo.SetMessage(ch.id, umsg)) {
+				return
+			}
 		}
 		//wait for hugo to rebuild
-		//TODO: add a channel for this?
-		time.Sleep(time.Second * 4)
+		if !success("hugo rebuild", s.waitForRebuild(builds)) {
+			return
+		}
 		//execute publish template
-		http.Redirect(w, req, fmt.Sprintf("/post/%s/?redirected=1", s.hugo.onDeck.name), int(http.StatusTemporaryRedirect))
-	})
+		http.Redirect(w, req, s.hugo.PostURL(ch.name)+"?redirected=1", int(http.StatusTemporaryRedirect))
+	}))
 
-	http.HandleFunc("/publish", func(w http.ResponseWriter, req *http.Request) {
+	mux.HandleFunc("/publish", stateChanging(func(w http.ResponseWriter, req *http.Request) {
 		success := func(err error) bool {
 			return !serverError("error handling publish: %s", w, err)
 		}
 
-		post := s.hugo.onDeck.name
-		if !success(s.hugo.Deploy()) {
+		ch, err := s.hugo.Change(req.FormValue("change"))
+		if !success(err) {
 			return
 		}
-		if !s.config.Test {
-			if !success(s.PostPush()) {
-				return
-			}
+		post := ch.name
+		res, err := s.publishChange(ch)
+		if !success(err) {
+			return
 		}
-		msg := fmt.Sprint("successfully published ", post)
-		_, err := w.Write([]byte(msg))
-		if err != nil {
-			log.Println("error writing success to publish response: ", err)
+		if sp := res.Scheduled; sp != nil {
+			msg := fmt.Sprintf("scheduled %s to be published at %s", post, sp.At.Format(time.RFC1123))
+			if _, err = w.Write([]byte(msg)); err != nil {
+				log.Println("error writing success to publish response: ", err)
+			}
+			return
 		}
-	})
+		results, running := res.actionResults()
+		success(publishPage.Execute(w, &PublishForm{
+			Message:     res.message("published", post),
+			PullRequest: res.PullRequest,
+			Results:     results,
+			PostPush:    running,
+		}))
+	}))
 
-	http.HandleFunc("/abort", func(w http.ResponseWriter, req *http.Request) {
-		post := req.URL.Query().Get("post")
+	mux.HandleFunc("/abort", stateChanging(func(w http.ResponseWriter, req *http.Request) {
 		success := func(err error) bool {
 			return !serverError("error handling abort: %s", w, err)
 		}
-		if !success(s.hugo.Abort()) {
+		ch, err := s.hugo.Change(req.FormValue("change"))
+		if !success(err) {
+			return
+		}
+		if !success(s.hugo.Abort(ch.id)) {
 			return
 		}
-		msg := fmt.Sprint("successfully aborted publishing ", post)
-		_, err := w.Write([]byte(msg))
+		msg := fmt.Sprint("successfully aborted publishing ", ch.name)
+		_, err = w.Write([]byte(msg))
 		if err != nil {
 			log.Println("error writing success to abort response: ", err)
 		}
+	}))
+
+	mux.HandleFunc("/unschedule", stateChanging(func(w http.ResponseWriter, req *http.Request) {
+		sp, err := s.scheduler.Cancel(req.FormValue("id"))
+		if serverError("error handling unschedule: %s", w, err) {
+			return
+		}
+		msg := fmt.Sprint("cancelled publishing scheduled post ", sp.Name)
+		if _, err = w.Write([]byte(msg)); err != nil {
+			log.Println("error writing success to unschedule response: ", err)
+		}
+	}))
+
+	mux.HandleFunc("/promote", stateChanging(func(w http.ResponseWriter, req *http.Request) {
+		post := req.FormValue("post")
+		success := func(err error) bool {
+			return !serverError("error handling promote: %s", w, err)
+		}
+		if len(post) == 0 {
+			success(errors.New("post parameter not set"))
+			return
+		}
+		pr, err := s.hugo.Promote(post, gitAuthor(req))
+		if !errors.Is(err, errSitePush) && !success(err) {
+			return
+		}
+		res := s.published(post, "promoted draft "+post, pr, err)
+		results, running := res.actionResults()
+		success(publishPage.Execute(w, &PublishForm{
+			Message:     res.message("promoted draft", post),
+			PullRequest: res.PullRequest,
+			Results:     results,
+			PostPush:    running,
+		}))
+	}))
+
+	mux.HandleFunc("/changes", func(w http.ResponseWriter, req *http.Request) {
+		form := &ChangesForm{Scheduled: s.scheduler.Queue(), CSRF: csrfToken(req)}
+		for _, c := range s.hugo.Changes() {
+			form.Changes = append(form.Changes, &changeView{
+				ID:        c.id,
+				Name:      c.name,
+				URL:       s.hugo.PostURL(c.name),
+				Msg:       c.msg,
+				Created:   c.created,
+				PublishAt: c.publishAt,
+			})
+		}
+		serverError("error executing template", w, changesPage.Execute(w, form))
 	})
 
-	http.HandleFunc("/new", func(w http.ResponseWriter, req *http.Request) {
+	mux.HandleFunc(apiPrefix, s.handleAPI)
+
+	mux.HandleFunc("/login", s.handleLogin)
+	mux.HandleFunc("/logout", stateChanging(s.handleLogout))
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		health := &hugoHealth{State: hugoStopped}
+		if s.preview != nil {
+			health = s.preview.Health()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if health.State != hugoRunning {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(health); err != nil {
+			log.Println("error writing health response: ", err)
+		}
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		serverError("error executing template", w, statusPage.Execute(w, &StatusForm{s.hugo.BuildStatus(), s.pushes.Recent(), csrfToken(req)}))
+	})
+
+	mux.HandleFunc("/new", func(w http.ResponseWriter, req *http.Request) {
 		upload := req.URL.Query().Get("upload")
 		var err error
 		var files []*drive.File
@@ -366,14 +1047,23 @@ func (s *server) startHttpServer(port string) {
 				return
 			}
 		}
+		images, picker, err := s.driveImages(req)
+		if err != nil {
+			serverError("error getting drive images: %s", w, err)
+			return
+		}
 		serverError("error executing template", w, input.Execute(w, &InputForm{
-			Action:     "/upload",
-			Fm:         new(frontMatter),
-			DriveFiles: files,
+			Action:      "/upload",
+			Fm:          new(frontMatter),
+			DriveFiles:  files,
+			DriveImages: images,
+			DrivePicker: picker,
+			Timezone:    s.timezone(),
+			CSRF:        csrfToken(req),
 		}))
 	})
 
-	http.HandleFunc("/edit", func(w http.ResponseWriter, req *http.Request) {
+	mux.HandleFunc("/edit", func(w http.ResponseWriter, req *http.Request) {
 		postname := req.URL.Query().Get("post")
 		if len(postname) == 0 {
 			serverError("%s", w, errors.New("post parameter not set"))
@@ -393,17 +1083,27 @@ func (s *server) startHttpServer(port string) {
 				return
 			}
 		}
+		images, picker, err := s.driveImages(req)
+		if err != nil {
+			serverError("error getting drive images: %s", w, err)
+			return
+		}
 		serverError("error executing template", w, input.Execute(w, &InputForm{
-			Action:     "/replace",
-			Fm:         post.frontMatter,
-			Postname:   postname,
-			DriveFiles: files,
+			Action:      "/replace",
+			Fm:          post.frontMatter,
+			Postname:    postname,
+			DriveFiles:  files,
+			DriveImages: images,
+			DrivePicker: picker,
+			Timezone:    s.timezone(),
+			CSRF:        csrfToken(req),
 		}))
 	})
 
+	posturlregxp := regexp.MustCompile(`(?m)/` + regexp.QuoteMeta(s.hugo.section()) + `/[a-zA-Z0-9]+`)
 	proxy := httputil.NewSingleHostReverseProxy(&url.URL{
 		Scheme: "http",
-		Host:   "localhost:1313",
+		Host:   s.hugoAddr,
 	})
 	proxy.ModifyResponse = func(response *http.Response) error {
 		response.Header.Set("Access-Control-Allow-Origin", "*")
@@ -414,6 +1114,11 @@ func (s *server) startHttpServer(port string) {
 		url := response.Request.URL
 		log.Println("requested url: ", url.String())
 
+		//public viewers of the preview don't get cms controls
+		if s.authEnabled() && requestUser(response.Request) == nil {
+			return nil
+		}
+
 		//if this is not an asset request
 		if !assetextregexp.MatchString(url.String()) {
 			doc, err := goquery.NewDocumentFromReader(response.Body)
@@ -423,28 +1128,43 @@ func (s *server) startHttpServer(port string) {
 			doc.Find("#navSubscribeBtn").AppendHtml(`
             <a href="/new" title="New Post">
                 <i class="fa fa-file fa-fw" aria-hidden="true"></i>
+            </a>
+            <a href="/changes" title="Pending Changes">
+                <i class="fa fa-list fa-fw" aria-hidden="true"></i>
+            </a>
+            <a href="/status" title="Build Status">
+                <i class="fa fa-heartbeat fa-fw" aria-hidden="true"></i>
             </a>`)
+			csrf := csrfToken(response.Request)
+			if s.authEnabled() {
+				doc.Find("#navSubscribeBtn").AppendHtml(actionForm("/logout", "", "", csrf, "Sign Out", "fa-sign-out"))
+			}
+
+			//show a banner while the site fails to build
+			if st := s.hugo.BuildStatus(); st.Failing {
+				doc.Find("body").PrependHtml(fmt.Sprintf(`
+            <div id="buildFailure" style="background:#c00;color:#fff;padding:1em">
+                hugo build failed: %s <a href="/status" style="color:#fff">details</a>
+            </div>`, template.HTMLEscapeString(st.Failure.Err)))
+			}
 
 			//if this is a request for a specific post
 			if posturlregxp.MatchString(url.String()) {
 				postname := PostnameFromURL(url.String())
 				editLink := "/edit?post=" + postname
-				if s.hugo.onDeck != nil {
-					if postname == s.hugo.onDeck.name {
-						//change edit link to back button (retains selected document)
-						//if redirected directly from new or edit page
-						if len(response.Request.URL.Query().Get("redirected")) > 0 {
-							editLink = "javascript:history.back()"
-						}
-						//inject abort / publish buttons
-						doc.Find("h1").AppendHtml(`
-            <a href="/publish" title="Publish Post">
-                <i class="fa fa-paper-plane fa-fw" aria-hidden="true"></i>
-            </a>
-            <a href="/abort" title="Abort Publish">
-                <i class="fa fa-ban fa-fw" aria-hidden="true"></i>
-            </a>`)
+				if ch := s.hugo.ChangeFor(postname); ch != nil {
+					//change edit link to back button (retains selected document)
+					//if redirected directly from new or edit page
+					if len(response.Request.URL.Query().Get("redirected")) > 0 {
+						editLink = "javascript:history.back()"
 					}
+					//inject abort / publish buttons
+					doc.Find("h1").AppendHtml(actionForm("/publish", "change", ch.id, csrf, "Publish Post", "fa-paper-plane"))
+					doc.Find("h1").AppendHtml(actionForm("/abort", "change", ch.id, csrf, "Abort Publish", "fa-ban"))
+				}
+				//inject promote button on drafts
+				if p, err := s.hugo.GetPost(postname); err == nil && p.frontMatter.Draft {
+					doc.Find("h1").AppendHtml(actionForm("/promote", "post", postname, csrf, "Promote Draft", "fa-check-circle"))
 				}
 				doc.Find("h1").AppendHtml(fmt.Sprintf(`
             <a href="%s" title="Edit Post">
@@ -460,7 +1180,6 @@ func (s *server) startHttpServer(port string) {
 		}
 		return nil
 	}
-	http.Handle("/", proxy)
-
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", s.config.Port), nil))
+	mux.Handle("/", proxy)
+	return withCSRF(s.requireAuth(mux))
 }
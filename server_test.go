@@ -1,6 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -16,3 +26,183 @@ func TestPostnameFromURL(t *testing.T) {
 		}
 	}
 }
+
+func TestDocumentMIME(t *testing.T) {
+	odt := append([]byte("PK\x03\x04"+strings.Repeat("\x00", 26)+"mimetype"), odtMIME...)
+	tests := []struct {
+		fname, contentType string
+		content            []byte
+		expected           string
+	}{
+		{"post.ODT", "application/octet-stream", nil, odtMIME},
+		{"post", docxMIME, odt, docxMIME},
+		{"post", "application/octet-stream", odt, odtMIME},
+		{"post.doc", "", []byte("PK\x03\x04"), docxMIME},
+		{"post", "", nil, docxMIME},
+	}
+	for _, test := range tests {
+		hdr := &multipart.FileHeader{Filename: test.fname, Header: textproto.MIMEHeader{}}
+		hdr.Header.Set("Content-Type", test.contentType)
+		if mime := documentMIME(bytes.NewReader(test.content), hdr); mime != test.expected {
+			t.Errorf("%s %q: expected %s got %s", test.fname, test.contentType, test.expected, mime)
+		}
+	}
+}
+
+//testServer returns a server for a test repo with its
+//preview proxy pointed at a fake hugo server
+func testServer(t *testing.T) (*server, http.Handler) {
+	rebuildTimeout = 0
+	hugo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `<html><body><div id="navSubscribeBtn"></div><h1>Post</h1></body></html>`)
+	}))
+	t.Cleanup(hugo.Close)
+
+	s := NewServer(&ServerConfig{Test: true})
+	s.hugo = testRepo(t)
+	s.hugo.test = true
+	s.hugoAddr = strings.TrimPrefix(hugo.URL, "http://")
+	var err error
+	s.scheduler, err = newScheduler(path.Join(s.hugo.path, ".git", "schedule.json"), s.publishScheduled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, s.handler()
+}
+
+//uploadRequest returns a multipart upload form request
+func uploadRequest(t *testing.T, title string) *http.Request {
+	return documentRequest(t, "/upload", url.Values{"title": {title}, "tags": {"test"}})
+}
+
+//documentRequest returns a multipart form request to path
+//with a document and the fields of form
+func documentRequest(t *testing.T, path string, form url.Values) *http.Request {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for k, vs := range form {
+		for _, v := range vs {
+			mw.WriteField(k, v)
+		}
+	}
+	fw, err := mw.CreateFormFile("userfile", "post.docx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("not really a docx"))
+	mw.WriteField(csrfField, testCSRF)
+	if err = mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: testCSRF})
+	return req
+}
+
+//testCSRF is the csrf token of test form requests
+const testCSRF = "test-csrf-token"
+
+//postRequest returns a form request to path with a csrf token
+func postRequest(path string, form url.Values) *http.Request {
+	form.Set(csrfField, testCSRF)
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: testCSRF})
+	return req
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	s, handler := testServer(t)
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	const n = 8
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("post%d", i)
+			if w := serve(uploadRequest(t, name)); w.Code != http.StatusTemporaryRedirect {
+				t.Errorf("%s: upload returned %d: %s", name, w.Code, w.Body)
+				return
+			}
+			//view the pending change through the proxy and changes page
+			if w := serve(httptest.NewRequest(http.MethodGet, "/post/"+name+"/", nil)); !strings.Contains(w.Body.String(), `action="/publish"`) {
+				t.Errorf("%s: preview missing publish button: %s", name, w.Body)
+			}
+			serve(httptest.NewRequest(http.MethodGet, "/changes", nil))
+
+			ch := s.hugo.ChangeFor(name)
+			if ch == nil {
+				t.Errorf("%s: no pending change", name)
+				return
+			}
+			action := "/publish"
+			if i%2 == 0 {
+				action = "/abort"
+			}
+			if w := serve(postRequest(action, url.Values{"change": {ch.id}})); w.Code != http.StatusOK {
+				t.Errorf("%s: %s returned %d: %s", name, action, w.Code, w.Body)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if changes := s.hugo.Changes(); len(changes) != 0 {
+		t.Errorf("expected no pending changes got %d", len(changes))
+	}
+	for i := 0; i < n; i++ {
+		_, err := s.hugo.GetPost(fmt.Sprintf("post%d", i))
+		if published := i%2 != 0; published != (err == nil) {
+			t.Errorf("post%d: expected published=%t got error %v", i, published, err)
+		}
+	}
+}
+
+func TestBuildFailure(t *testing.T) {
+	s, handler := testServer(t)
+	ch, err := s.hugo.New(strings.NewReader(""), docxMIME, &postDetails{Title: "Broken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(s.hugo.output, "Built in 10 ms\nChange detected, rebuilding site.\n"+
+		"ERROR 2021/02/20 12:00:01 Rebuild failed:\n"+
+		"ERROR 2021/02/20 12:00:01 \"%s/content/post/broken.md:1:1\": <b>unmarshal</b> failed\n", s.hugo.path)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/post/broken/", nil))
+	if body := w.Body.String(); !strings.Contains(body, `id="buildFailure"`) || !strings.Contains(body, "&lt;b&gt;unmarshal&lt;/b&gt; failed") {
+		t.Errorf("preview missing build failure banner: %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if body := w.Body.String(); !strings.Contains(body, `href="/post/broken/"`) || !strings.Contains(body, `name="change" value="`+ch.id+`"`) {
+		t.Errorf("status page missing failed post: %s", body)
+	}
+}
+
+func TestInvalidPostName(t *testing.T) {
+	s, handler := testServer(t)
+	s.hugo.converter = &stubConverter{&Conversion{Markdown: []byte("replaced\n")}}
+	const name = "../../../x"
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/edit?post="+url.QueryEscape(name), nil),
+		documentRequest(t, "/replace", url.Values{"title": {"X"}, "postname": {name}}),
+		postRequest("/promote", url.Values{"post": {name}}),
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s returned %d: %s", req.URL.Path, w.Code, w.Body)
+		}
+	}
+	if changes := s.hugo.Changes(); len(changes) != 0 {
+		t.Errorf("expected no pending changes got %d", len(changes))
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+//hugo preview process states
+const (
+	hugoStarting   = "starting"
+	hugoRunning    = "running"
+	hugoRestarting = "restarting"
+	hugoFailed     = "failed"
+	hugoStopped    = "stopped"
+)
+
+//defaultMaxFailures is how many times in a row hugo
+//can fail before the supervisor gives up
+const defaultMaxFailures = 5
+
+//supervisor runs the hugo preview server restarting
+//it with backoff whenever it exits
+type supervisor struct {
+	mu sync.Mutex
+	//start starts the process returning a channel
+	//its exit error is sent on
+	start func(ctx context.Context) (chan error, error)
+	//consecutive failures allowed before giving up
+	maxFailures int
+	//backoff before the first restart. It doubles
+	//with each failure up to maxBackoff
+	backoff    time.Duration
+	maxBackoff time.Duration
+	//a process that runs for stableRun resets the failure count
+	stableRun time.Duration
+
+	state    string
+	failures int
+	lastErr  error
+	since    time.Time
+}
+
+//hugoHealth is the state of the hugo preview process
+type hugoHealth struct {
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"lasterror,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+func newSupervisor(start func(ctx context.Context) (chan error, error), maxFailures int) *supervisor {
+	if maxFailures <= 0 {
+		maxFailures = defaultMaxFailures
+	}
+	return &supervisor{
+		start:       start,
+		maxFailures: maxFailures,
+		backoff:     time.Second,
+		maxBackoff:  time.Minute,
+		stableRun:   time.Minute,
+		state:       hugoStarting,
+		since:       time.Now(),
+	}
+}
+
+//setState records the process state
+func (s *supervisor) setState(state string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	s.since = time.Now()
+	if err != nil {
+		s.lastErr = err
+	}
+}
+
+//Health returns the state of the hugo process
+func (s *supervisor) Health() *hugoHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := &hugoHealth{State: s.state, Failures: s.failures, Since: s.since}
+	if s.lastErr != nil {
+		h.LastError = s.lastErr.Error()
+	}
+	return h
+}
+
+//Run starts hugo and restarts it when it exits until
+//ctx is done or it fails maxFailures times in a row
+//in which case the last error is returned
+func (s *supervisor) Run(ctx context.Context) error {
+	backoff := s.backoff
+	for {
+		started := time.Now()
+		exited, err := s.start(ctx)
+		if err == nil {
+			s.setState(hugoRunning, nil)
+			err = <-exited
+		}
+		if ctx.Err() != nil {
+			s.setState(hugoStopped, nil)
+			return nil
+		}
+		if err == nil {
+			err = errors.New("hugo server exited")
+		}
+
+		s.mu.Lock()
+		//a long running process is not a repeated failure
+		if time.Since(started) >= s.stableRun {
+			s.failures = 0
+			backoff = s.backoff
+		}
+		s.failures++
+		failures := s.failures
+		s.mu.Unlock()
+
+		if failures >= s.maxFailures {
+			err = fmt.Errorf("hugo server failed %d times: %s", failures, err)
+			log.Println(err)
+			s.setState(hugoFailed, err)
+			return err
+		}
+		log.Printf("hugo server stopped: %s. restarting in %s\n", err, backoff)
+		s.setState(hugoRestarting, err)
+		select {
+		case <-ctx.Done():
+			s.setState(hugoStopped, nil)
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
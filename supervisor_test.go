@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//testSupervisor returns a supervisor with short backoffs
+func testSupervisor(start func(ctx context.Context) (chan error, error), maxFailures int) *supervisor {
+	s := newSupervisor(start, maxFailures)
+	s.backoff = time.Millisecond
+	s.maxBackoff = 4 * time.Millisecond
+	return s
+}
+
+func TestSupervisorGivesUp(t *testing.T) {
+	starts := 0
+	s := testSupervisor(func(ctx context.Context) (chan error, error) {
+		starts++
+		//fail to start once then exit straight away
+		if starts == 1 {
+			return nil, errors.New("exec: hugo not found")
+		}
+		c := make(chan error, 1)
+		c <- errors.New("exit status 255")
+		return c, nil
+	}, 3)
+	if err := s.Run(context.Background()); err == nil {
+		t.Fatal("expected supervisor to give up")
+	}
+	if starts != 3 {
+		t.Errorf("expected 3 starts got %d", starts)
+	}
+	if h := s.Health(); h.State != hugoFailed || h.Failures != 3 || len(h.LastError) == 0 {
+		t.Errorf("unexpected health %+v", h)
+	}
+}
+
+func TestSupervisorRestarts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	exits := make(chan chan error, 10)
+	s := testSupervisor(func(ctx context.Context) (chan error, error) {
+		c := make(chan error, 1)
+		//exit when killed like exec.CommandContext
+		go func() {
+			<-ctx.Done()
+			c <- ctx.Err()
+		}()
+		exits <- c
+		return c, nil
+	}, 2)
+	//a process that ran for a while doesn't count
+	//towards the failure limit
+	s.stableRun = 0
+	done := make(chan error)
+	go func() { done <- s.Run(ctx) }()
+
+	for i := 0; i < 3; i++ {
+		(<-exits) <- errors.New("killed")
+	}
+	<-exits
+	for i := 0; s.Health().State != hugoRunning; i++ {
+		if i == 100 {
+			t.Fatalf("expected hugo to be running got %+v", s.Health())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error stopping supervisor: %s", err)
+	}
+	if h := s.Health(); h.State != hugoStopped {
+		t.Errorf("expected hugo to be stopped got %+v", h)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	s, handler := testServer(t)
+	s.preview = newSupervisor(nil, 0)
+	for state, code := range map[string]int{
+		hugoRunning:    http.StatusOK,
+		hugoRestarting: http.StatusServiceUnavailable,
+		hugoFailed:     http.StatusServiceUnavailable,
+	} {
+		s.preview.setState(state, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if w.Code != code {
+			t.Errorf("%s: expected status %d got %d", state, code, w.Code)
+		}
+		health := new(hugoHealth)
+		if err := json.NewDecoder(w.Body).Decode(health); err != nil || health.State != state {
+			t.Errorf("%s: unexpected health response %+v: %v", state, health, err)
+		}
+	}
+}